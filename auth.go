@@ -0,0 +1,164 @@
+package bidirpc
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"time"
+)
+
+// Credentials are what a client presents during the handshake.
+type Credentials struct {
+	ClientID   string
+	AuthCode   string
+	RemoteAddr net.Addr
+	TLS        *tls.ConnectionState // nil for plain TCP
+	Token      string               // bearer token, see JWTAuthenticator
+
+	// Set for challenge-response authentication, see AuthMethodHMAC.
+	Method string
+	Nonce  []byte // the challenge sent by the server
+	Proof  []byte // the client's answer
+}
+
+// Identity describes an authenticated client. It is attached to the
+// connection and available to handlers through Context.Identity.
+type Identity struct {
+	ClientID string // overrides the ID claimed by the client when set
+	Tenant   string
+	Roles    []string
+	Claims   map[string]any
+
+	// ExpiresAt ends the session unless the client reauthenticates first.
+	// The zero value never expires.
+	ExpiresAt time.Time
+}
+
+// HasRole reports whether the identity has role.
+func (id *Identity) HasRole(role string) bool {
+	return id != nil && slices.Contains(id.Roles, role)
+}
+
+// Authenticator validates the credentials presented by a client. It returns
+// the client's identity, or an error to refuse the connection. An *AuthError
+// is reported to the client; other errors are only logged on the server.
+type Authenticator interface {
+	Authenticate(ctx context.Context, creds Credentials) (*Identity, error)
+}
+
+// AuthenticatorFunc adapts an ordinary function to the Authenticator interface.
+type AuthenticatorFunc func(ctx context.Context, creds Credentials) (*Identity, error)
+
+func (f AuthenticatorFunc) Authenticate(ctx context.Context, creds Credentials) (*Identity, error) {
+	return f(ctx, creds)
+}
+
+// AuthError rejects a client with a reason the client gets to see. It
+// matches ErrAuthFailed with errors.Is.
+type AuthError struct {
+	Code    string `json:"code"` // machine-readable, e.g. "invalid_credentials"
+	Message string `json:"message"`
+}
+
+func (e *AuthError) Error() string {
+	return fmt.Sprintf("authentication failed: %s (%s)", e.Message, e.Code)
+}
+
+func (e *AuthError) Is(target error) bool {
+	return target == ErrAuthFailed
+}
+
+// errInvalidCredentials is reported when the function given to NewServer
+// refuses a client.
+var errInvalidCredentials = &AuthError{Code: "invalid_credentials", Message: "invalid credentials"}
+
+// checkFunc turns the credential check accepted by NewServer into an
+// Authenticator.
+func checkFunc(fn func(clientID, authCode string) bool) Authenticator {
+	if fn == nil {
+		return nil
+	}
+	return AuthenticatorFunc(func(ctx context.Context, creds Credentials) (*Identity, error) {
+		if !fn(creds.ClientID, creds.AuthCode) {
+			return nil, errInvalidCredentials
+		}
+		return &Identity{ClientID: creds.ClientID}, nil
+	})
+}
+
+// SetAuthenticator replaces the credential check given to NewServer.
+func (s *Server) SetAuthenticator(auth Authenticator) {
+	s.clientsMu.Lock()
+	defer s.clientsMu.Unlock()
+	s.auth = auth
+}
+
+// authenticate runs the server's Authenticator for the handshake in negMsg.
+// Errors always match ErrAuthFailed.
+func (s *Server) authenticate(c *Connection, negMsg NegotiationMessage) (*Identity, error) {
+	s.clientsMu.RLock()
+	auth := s.auth
+	s.clientsMu.RUnlock()
+	if auth == nil {
+		return nil, fmt.Errorf("%w: no authenticator configured", ErrAuthFailed)
+	}
+
+	creds := Credentials{
+		ClientID:   negMsg.ClientID,
+		AuthCode:   negMsg.AuthCode,
+		RemoteAddr: c.Conn.RemoteAddr(),
+		Token:      negMsg.Token,
+		Method:     negMsg.AuthMethod,
+		Nonce:      negMsg.Nonce,
+		Proof:      negMsg.Proof,
+	}
+	if tc, ok := c.Conn.(*tls.Conn); ok {
+		state := tc.ConnectionState()
+		creds.TLS = &state
+	}
+
+	identity, err := auth.Authenticate(c.ctx, creds)
+	if err != nil {
+		if !errors.Is(err, ErrAuthFailed) {
+			err = fmt.Errorf("%w: %w", ErrAuthFailed, err)
+		}
+		return nil, err
+	}
+	if identity == nil {
+		identity = &Identity{}
+	}
+	if !identity.ExpiresAt.IsZero() && !time.Now().Before(identity.ExpiresAt) {
+		return nil, &AuthError{Code: "credentials_expired", Message: "credentials expired"}
+	}
+	if identity.ClientID == "" {
+		identity.ClientID = negMsg.ClientID
+	}
+	return identity, nil
+}
+
+// authFailure builds the auth_fail message for err. Only an *AuthError's
+// details are sent to the client.
+func authFailure(err error) NegotiationMessage {
+	resp := NegotiationMessage{Type: AuthFailType}
+	var authErr *AuthError
+	if errors.As(err, &authErr) {
+		resp.Reason = authErr.Message
+		resp.ReasonCode = authErr.Code
+	}
+	return resp
+}
+
+// Identity returns the identity the client authenticated with. It is nil on
+// the client side of a connection.
+func (c *Connection) Identity() *Identity {
+	return c.identity.Load()
+}
+
+// Identity returns the identity of the client that sent the current request.
+// See Connection.Identity.
+func (ctx *Context) Identity() *Identity {
+	return ctx.conn.Identity()
+}
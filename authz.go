@@ -0,0 +1,124 @@
+package bidirpc
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Policy decides whether a caller with the given identity may call a
+// method. The identity is nil for peers that did not authenticate with the
+// receiving side, such as the server as seen from a client.
+type Policy func(id *Identity) bool
+
+// RequireRoles returns a Policy satisfied by identities having every role.
+func RequireRoles(roles ...string) Policy {
+	return func(id *Identity) bool {
+		for _, role := range roles {
+			if !id.HasRole(role) {
+				return false
+			}
+		}
+		return id != nil
+	}
+}
+
+// Authorize sets the policy checked before the handler of method runs.
+// Calls the policy refuses are answered with ErrCodeForbidden. It applies to
+// regular and stream handlers and may be set before or after registering
+// them.
+func (hr *HandlerRegistry) Authorize(method string, policy Policy) {
+	hr.mu.Lock()
+	defer hr.mu.Unlock()
+	hr.policies[method] = policy
+	hr.rebuild()
+}
+
+// SetDefaultPolicy sets the policy of methods without one of their own,
+// e.g. to deny by default. A nil policy allows every caller.
+func (hr *HandlerRegistry) SetDefaultPolicy(policy Policy) {
+	hr.mu.Lock()
+	defer hr.mu.Unlock()
+	hr.defaultPolicy = policy
+	hr.rebuild()
+}
+
+// authorized wraps fn in the policy of method, if any. Callers hold hr.mu.
+func (hr *HandlerRegistry) authorized(method string, fn HandlerFunc) HandlerFunc {
+	policy, ok := hr.policies[method]
+	if !ok {
+		policy = hr.defaultPolicy
+	}
+	if policy == nil {
+		return fn
+	}
+	return func(ctx *Context) {
+		if !policy(ctx.Identity()) {
+			ctx.WriteError(ErrCodeForbidden, "forbidden")
+			return
+		}
+		fn(ctx)
+	}
+}
+
+// AuthorizeTopic sets the policy a peer must satisfy to subscribe to topic
+// or to publish on it. Topics without a policy of their own use the default
+// policy. Refused messages are dropped.
+func (hr *HandlerRegistry) AuthorizeTopic(topic string, policy Policy) {
+	hr.mu.Lock()
+	defer hr.mu.Unlock()
+	hr.topicPolicies[topic] = policy
+}
+
+// topicAllowed reports whether a peer with identity id may subscribe to or
+// publish on topic.
+func (hr *HandlerRegistry) topicAllowed(topic string, id *Identity) bool {
+	hr.mu.RLock()
+	policy, ok := hr.topicPolicies[topic]
+	if !ok {
+		policy = hr.defaultPolicy
+	}
+	hr.mu.RUnlock()
+	return policy == nil || policy(id)
+}
+
+// ErrCallForbidden is returned for outgoing calls refused by the server's
+// call policy.
+var ErrCallForbidden = errors.New("call not allowed by policy")
+
+// CallPolicy decides whether method may be invoked on the peer of c.
+type CallPolicy func(c *Connection, method string) bool
+
+// checkCall applies the call policy of the connection's owner to an outgoing
+// call, notification or stream.
+func (c *Connection) checkCall(method string) error {
+	if c.callPolicy != nil && !c.callPolicy(c, method) {
+		return fmt.Errorf("%w: %s on %s", ErrCallForbidden, method, c.clientID)
+	}
+	return nil
+}
+
+// Authorize sets the policy checked before the handler of method runs. See
+// HandlerRegistry.Authorize.
+func (s *Server) Authorize(method string, policy Policy) {
+	s.handlers.Authorize(method, policy)
+}
+
+// AuthorizeTopic sets the policy clients must satisfy to subscribe to topic
+// or to publish on it. See HandlerRegistry.AuthorizeTopic.
+func (s *Server) AuthorizeTopic(topic string, policy Policy) {
+	s.handlers.AuthorizeTopic(topic, policy)
+}
+
+// SetCallPolicy restricts the methods the server may invoke on each
+// client. Refused calls, notifications and streams fail locally with
+// ErrCallForbidden without reaching the client.
+func (s *Server) SetCallPolicy(policy CallPolicy) {
+	s.callPolicy.Store(policy)
+}
+
+func (s *Server) allowCall(c *Connection, method string) bool {
+	if fn, _ := s.callPolicy.Load().(CallPolicy); fn != nil {
+		return fn(c, method)
+	}
+	return true
+}
@@ -1,6 +1,7 @@
 package bidirpc
 
 import (
+	"context"
 	"crypto/tls"
 	"fmt"
 	"log"
@@ -20,13 +21,25 @@ type AutoClient struct {
 	tlsConfig      *tls.Config
 	ALPN           string
 	useCompression bool
+	codecs         []string
+	framing        bool
+	hmacSecret     []byte      // set by UseHMACAuth
+	tokenSource    TokenSource // set by UseTokenAuth
+	maxFrameSize   int
 	onReady        func(*Connection)
 	stopChan       chan struct{}
 	wg             sync.WaitGroup
 	mu             sync.Mutex
 	stopped        bool
 	handlers       *HandlerRegistry
-	activeConn     atomic.Value // stores *Connection
+	topics         *topicRegistry
+	interceptors   *interceptorChain
+	panicHook      atomic.Value // stores PanicHandler
+	connectHook    atomic.Value // stores ConnectHandler
+	discHook       atomic.Value // stores DisconnectHandler
+	reconnectHook  atomic.Value // stores func(attempt int)
+	authFailHook   atomic.Value // stores func(err error)
+	activeConn     atomic.Pointer[Connection]
 }
 
 // NewAutoClient creates an AutoClient instance ready to connect.
@@ -42,12 +55,134 @@ func NewAutoClient(addr, clientID, authCode string, useTLS bool, tlsConfig *tls.
 		onReady:        onReady,
 		stopChan:       make(chan struct{}),
 		handlers:       NewHandlerRegistry(),
+		topics:         newTopicRegistry(),
+		interceptors:   &interceptorChain{},
 	}
 }
 
-// RegisterHandler registers a handler before starting the client.
-func (ac *AutoClient) RegisterHandler(method string, fn HandlerFunc) {
-	ac.handlers.Register(method, fn)
+// SetCodecs sets the codecs offered to the server, most preferred first.
+// The server picks one it supports, falling back to JSON. Call it before Start.
+func (ac *AutoClient) SetCodecs(names ...string) {
+	ac.mu.Lock()
+	defer ac.mu.Unlock()
+	ac.codecs = names
+}
+
+// UseFraming asks the server for length-prefixed frames, which survive
+// malformed messages. A frame from the server larger than maxFrameSize
+// closes the connection; 0 means DefaultMaxFrameSize. Call it before Start.
+func (ac *AutoClient) UseFraming(maxFrameSize int) {
+	ac.mu.Lock()
+	defer ac.mu.Unlock()
+	ac.framing = true
+	ac.maxFrameSize = maxFrameSize
+}
+
+// UseHMACAuth authenticates with a challenge-response proof of secret
+// instead of sending the auth code, which is then ignored. The server must
+// use HMACAuthenticator. Call it before Start.
+func (ac *AutoClient) UseHMACAuth(secret []byte) {
+	ac.mu.Lock()
+	defer ac.mu.Unlock()
+	ac.hmacSecret = secret
+}
+
+// UseTokenAuth authenticates with bearer tokens from source, e.g. JWTs for
+// a server using JWTAuthenticator. A token is fetched for every connection
+// and, if the server reports an expiry, again before it lapses to renew the
+// session in place. Call it before Start.
+func (ac *AutoClient) UseTokenAuth(source TokenSource) {
+	ac.mu.Lock()
+	defer ac.mu.Unlock()
+	ac.tokenSource = source
+}
+
+// capabilities returns the protocol features offered to the server.
+func (ac *AutoClient) capabilities() Capabilities {
+	ac.mu.Lock()
+	defer ac.mu.Unlock()
+	caps := Capabilities{
+		Codecs:         ac.codecs,
+		Framing:        ac.framing,
+		Cancellation:   true,
+		Streaming:      true,
+		MaxMessageSize: ac.maxFrameSize,
+	}
+	if ac.useCompression {
+		caps.Compression = []string{CompressionGzip}
+	}
+	return caps
+}
+
+// RegisterHandler registers a handler before starting the client, optionally
+// wrapped in per-method middleware.
+func (ac *AutoClient) RegisterHandler(method string, fn HandlerFunc, mw ...Middleware) {
+	ac.handlers.Register(method, fn, mw...)
+}
+
+// RegisterStreamHandler registers a handler for streams opened by the
+// server with OpenStream.
+func (ac *AutoClient) RegisterStreamHandler(method string, fn StreamHandlerFunc, mw ...Middleware) {
+	ac.handlers.RegisterStream(method, fn, mw...)
+}
+
+// RegisterService registers the exported methods of svc as "name.Method"
+// handlers. See HandlerRegistry.RegisterService.
+func (ac *AutoClient) RegisterService(name string, svc any) error {
+	return ac.handlers.RegisterService(name, svc)
+}
+
+// Handlers returns the registry used for every connection, e.g. for use
+// with Handle.
+func (ac *AutoClient) Handlers() *HandlerRegistry {
+	return ac.handlers
+}
+
+// Use appends middleware applied to every handler of the client.
+func (ac *AutoClient) Use(mw ...Middleware) {
+	ac.handlers.Use(mw...)
+}
+
+// OnPanic sets a hook called with the stack trace whenever a handler panics.
+// The panic is always recovered and reported to the caller as ErrCodeHandlerPanic.
+func (ac *AutoClient) OnPanic(fn PanicHandler) {
+	ac.panicHook.Store(fn)
+}
+
+func (ac *AutoClient) handlePanic(ctx *Context, recovered any, stack []byte) {
+	if fn, _ := ac.panicHook.Load().(PanicHandler); fn != nil {
+		fn(ctx, recovered, stack)
+	}
+}
+
+// OnConnect sets a function called every time a connection to the server
+// is established, after onReady.
+func (ac *AutoClient) OnConnect(fn ConnectHandler) {
+	ac.connectHook.Store(fn)
+}
+
+// OnDisconnect sets a function called as soon as the connection to the
+// server is lost, before any reconnect attempt.
+func (ac *AutoClient) OnDisconnect(fn DisconnectHandler) {
+	ac.discHook.Store(fn)
+}
+
+// OnReconnecting sets a function called before each reconnect attempt,
+// starting at 1 after every disconnect.
+func (ac *AutoClient) OnReconnecting(fn func(attempt int)) {
+	ac.reconnectHook.Store(fn)
+}
+
+// OnAuthFailed sets a function called when the server rejects the client's
+// credentials.
+func (ac *AutoClient) OnAuthFailed(fn func(err error)) {
+	ac.authFailHook.Store(fn)
+}
+
+// UseInterceptor appends interceptors run around every call the client makes
+// to the server. They are kept across reconnections.
+func (ac *AutoClient) UseInterceptor(interceptors ...Interceptor) {
+	ac.interceptors.use(interceptors...)
 }
 
 // Start initiates the first connection and begins auto-reconnect loop.
@@ -55,15 +190,13 @@ func (ac *AutoClient) RegisterHandler(method string, fn HandlerFunc) {
 func (ac *AutoClient) Start() error {
 	ready := make(chan error, 1)
 
+	ac.wg.Add(1)
 	go func() {
+		defer ac.wg.Done()
 		err := ac.connectOnce()
 		ready <- err
 		if err == nil {
-			ac.wg.Add(1)
-			go func() {
-				defer ac.wg.Done()
-				ac.loop()
-			}()
+			ac.loop()
 		}
 	}()
 
@@ -75,23 +208,57 @@ func (ac *AutoClient) Start() error {
 	}
 }
 
+// Stop ends the reconnect loop and closes the active connection. When it
+// returns, OnDisconnect has been called. A stopped client cannot be restarted.
+func (ac *AutoClient) Stop() {
+	ac.mu.Lock()
+	if ac.stopped {
+		ac.mu.Unlock()
+		return
+	}
+	ac.stopped = true
+	close(ac.stopChan)
+	ac.mu.Unlock()
+
+	ac.wg.Wait()
+	if c := ac.activeConn.Load(); c != nil {
+		c.Close()
+		<-c.readDone
+	}
+}
+
+// loop waits for the active connection to drop and reconnects, backing off
+// after failed attempts, until Stop is called.
 func (ac *AutoClient) loop() {
 	attempt := 1
 	for {
+		if c := ac.activeConn.Load(); c != nil {
+			select {
+			case <-ac.stopChan:
+				return
+			case <-c.readDone:
+			}
+		}
+
 		select {
 		case <-ac.stopChan:
 			return
 		default:
-			err := ac.connectOnce()
-			if err != nil {
-				log.Printf("[client] reconnect failed (attempt %d): %v", attempt, err)
-				delay := backoffDuration(attempt)
-				time.Sleep(delay)
-				attempt++
-			} else {
-				attempt = 1 // Reset on successful connection
+		}
+		if fn, _ := ac.reconnectHook.Load().(func(int)); fn != nil {
+			fn(attempt)
+		}
+		if err := ac.connectOnce(); err != nil {
+			log.Printf("[client] reconnect failed (attempt %d): %v", attempt, err)
+			select {
+			case <-ac.stopChan:
+				return
+			case <-time.After(backoffDuration(attempt)):
 			}
+			attempt++
+			continue
 		}
+		attempt = 1 // Reset on successful connection
 	}
 }
 
@@ -123,12 +290,34 @@ func (ac *AutoClient) connectOnce() error {
 	c := NewConnection(conn)
 
 	// Send negotiation
-	err = c.SendNegotiation(NegotiationMessage{
+	offer := ac.capabilities()
+	negMsg := NegotiationMessage{
 		Type:           AuthRequestType,
 		ClientID:       ac.clientID,
 		AuthCode:       ac.authCode,
 		UseCompression: ac.useCompression,
-	})
+		Version:        ProtocolVersion,
+		Capabilities:   &offer,
+	}
+	ac.mu.Lock()
+	secret := ac.hmacSecret
+	tokenSource := ac.tokenSource
+	ac.mu.Unlock()
+	if secret != nil {
+		negMsg.AuthCode = ""
+		negMsg.AuthMethod = AuthMethodHMAC
+	}
+	if tokenSource != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		negMsg.Token, err = tokenSource(ctx)
+		cancel()
+		if err != nil {
+			log.Println("[client] failed to get token:", err)
+			conn.Close()
+			return err
+		}
+	}
+	err = c.SendNegotiation(negMsg)
 	if err != nil {
 		log.Println("[client] failed to send negotiation:", err)
 		conn.Close()
@@ -137,6 +326,9 @@ func (ac *AutoClient) connectOnce() error {
 
 	var resp NegotiationMessage
 	err = c.ReceiveNegotiation(&resp)
+	if err == nil && secret != nil {
+		err = c.answerChallenge(ac.clientID, secret, &resp)
+	}
 	if err != nil {
 		log.Println("[client] failed to receive negotiation:", err)
 		conn.Close()
@@ -146,27 +338,56 @@ func (ac *AutoClient) connectOnce() error {
 	if resp.Type != AuthOKType {
 		log.Println("[client] server rejected authentication")
 		conn.Close()
-		return fmt.Errorf("authentication failed")
+		var err error = ErrAuthFailed
+		if resp.Reason != "" || resp.ReasonCode != "" {
+			err = &AuthError{Code: resp.ReasonCode, Message: resp.Reason}
+		}
+		if fn, _ := ac.authFailHook.Load().(func(error)); fn != nil {
+			fn(err)
+		}
+		return err
 	}
 
-	if resp.UseCompression {
-		if err := c.EnableCompression(); err != nil {
-			log.Println("[client] compression failed:", err)
-			conn.Close()
-			return err
-		}
+	if err := c.ApplyNegotiation(resp); err != nil {
+		log.Println("[client] failed to apply negotiation:", err)
+		conn.Close()
+		return err
 	}
 
 	// Initialize handlers and reader
 	c.handlers = ac.handlers
+	c.topics = ac.topics
+	c.interceptors = &interceptorChain{parent: ac.interceptors}
+	c.onPanic = ac.handlePanic
+
+	connected := make(chan struct{})
+	c.onDisconnect = func(reason error) {
+		<-connected
+		ac.activeConn.CompareAndSwap(c, nil)
+		log.Println("[client] disconnected:", reason)
+		if fn, _ := ac.discHook.Load().(DisconnectHandler); fn != nil {
+			fn(c, reason)
+		}
+	}
+
 	c.StartReadLoop()
 	ac.activeConn.Store(c)
 
+	// Restore our subscriptions on the new connection
+	c.announceTopics()
+
 	if ac.onReady != nil {
 		ac.onReady(c)
 	}
+	if fn, _ := ac.connectHook.Load().(ConnectHandler); fn != nil {
+		fn(c)
+	}
+	close(connected)
 
-	ac.startHeartbeat(DefaultHeartbeatInterval)
+	go ac.heartbeat(c, DefaultHeartbeatInterval)
+	if tokenSource != nil {
+		go ac.refreshCredentials(c, tokenSource)
+	}
 
 	return nil
 }
@@ -177,7 +398,7 @@ func (ac *AutoClient) Call(method string, params map[string]any, timeout time.Du
 	if value == nil {
 		return nil, fmt.Errorf("client is not connected")
 	}
-	return value.(*Connection).Call(method, params, timeout)
+	return value.Call(method, params, timeout)
 }
 
 // CallWithResult performs a blocking RPC call and decodes into resultPtr.
@@ -186,7 +407,7 @@ func (ac *AutoClient) CallWithResult(method string, params map[string]any, timeo
 	if value == nil {
 		return fmt.Errorf("client is not connected")
 	}
-	return value.(*Connection).CallWithResult(method, params, timeout, resultPtr)
+	return value.CallWithResult(method, params, timeout, resultPtr)
 }
 
 // CallAsync performs an async RPC call with a callback.
@@ -195,7 +416,7 @@ func (ac *AutoClient) CallAsync(method string, params map[string]any, timeout ti
 	if value == nil {
 		return fmt.Errorf("client is not connected")
 	}
-	value.(*Connection).CallAsync(method, params, timeout, callback)
+	value.CallAsync(method, params, timeout, callback)
 	return nil
 }
 
@@ -205,38 +426,129 @@ func (ac *AutoClient) CallAsyncWithResult(method string, params map[string]any,
 	if value == nil {
 		return fmt.Errorf("client is not connected")
 	}
-	value.(*Connection).CallAsyncWithResult(method, params, timeout, resultPtr, callback)
+	value.CallAsyncWithResult(method, params, timeout, resultPtr, callback)
+	return nil
+}
+
+// CallContext performs a blocking RPC call using the active connection, waiting until ctx is done.
+func (ac *AutoClient) CallContext(ctx context.Context, method string, params map[string]any) (any, error) {
+	value := ac.activeConn.Load()
+	if value == nil {
+		return nil, fmt.Errorf("client is not connected")
+	}
+	return value.CallContext(ctx, method, params)
+}
+
+// CallWithResultContext performs a blocking RPC call and decodes into resultPtr.
+func (ac *AutoClient) CallWithResultContext(ctx context.Context, method string, params map[string]any, resultPtr any) error {
+	value := ac.activeConn.Load()
+	if value == nil {
+		return fmt.Errorf("client is not connected")
+	}
+	return value.CallWithResultContext(ctx, method, params, resultPtr)
+}
+
+// CallAsyncContext performs an async RPC call with a callback, bounded by ctx.
+func (ac *AutoClient) CallAsyncContext(ctx context.Context, method string, params map[string]any, callback func(any, error)) error {
+	value := ac.activeConn.Load()
+	if value == nil {
+		return fmt.Errorf("client is not connected")
+	}
+	value.CallAsyncContext(ctx, method, params, callback)
+	return nil
+}
+
+// CallAsyncWithResultContext performs an async RPC call and decodes into resultPtr, bounded by ctx.
+func (ac *AutoClient) CallAsyncWithResultContext(ctx context.Context, method string, params map[string]any, resultPtr any, callback func(error)) error {
+	value := ac.activeConn.Load()
+	if value == nil {
+		return fmt.Errorf("client is not connected")
+	}
+	value.CallAsyncWithResultContext(ctx, method, params, resultPtr, callback)
 	return nil
 }
 
+// CallStream calls a streaming handler on the server. See Connection.CallStream.
+func (ac *AutoClient) CallStream(ctx context.Context, method string, params map[string]any) (*ResponseStream, error) {
+	value := ac.activeConn.Load()
+	if value == nil {
+		return nil, fmt.Errorf("client is not connected")
+	}
+	return value.CallStream(ctx, method, params)
+}
+
+// Notify sends a one-way notification to the server. See Connection.Notify.
+func (ac *AutoClient) Notify(method string, params map[string]any) error {
+	value := ac.activeConn.Load()
+	if value == nil {
+		return fmt.Errorf("client is not connected")
+	}
+	return value.Notify(method, params)
+}
+
+// Subscribe registers fn for a topic published by the server. The
+// subscription is restored on every reconnect.
+func (ac *AutoClient) Subscribe(topic string, fn TopicHandler) error {
+	ac.topics.set(topic, fn)
+	value := ac.activeConn.Load()
+	if value == nil {
+		return nil
+	}
+	return value.sendTopic(SubscribeType, topic)
+}
+
+// Unsubscribe removes the handler for topic.
+func (ac *AutoClient) Unsubscribe(topic string) error {
+	ac.topics.remove(topic)
+	value := ac.activeConn.Load()
+	if value == nil {
+		return nil
+	}
+	return value.sendTopic(UnsubscribeType, topic)
+}
+
+// Publish sends payload to the server if it is subscribed to topic. See
+// Connection.Publish.
+func (ac *AutoClient) Publish(topic string, payload any) error {
+	value := ac.activeConn.Load()
+	if value == nil {
+		return fmt.Errorf("client is not connected")
+	}
+	return value.Publish(topic, payload)
+}
+
+// OpenStream opens a bidirectional stream to the server. See Connection.OpenStream.
+func (ac *AutoClient) OpenStream(ctx context.Context, method string, params map[string]any) (*Stream, error) {
+	value := ac.activeConn.Load()
+	if value == nil {
+		return nil, fmt.Errorf("client is not connected")
+	}
+	return value.OpenStream(ctx, method, params)
+}
+
 // IsConnected returns true if a connection is active.
 func (ac *AutoClient) IsConnected() bool {
 	return ac.activeConn.Load() != nil
 }
 
-func (ac *AutoClient) startHeartbeat(interval time.Duration) {
-	go func() {
-		for {
-			select {
-			case <-ac.stopChan:
+// heartbeat pings the server over c until c is closed. A failed ping closes
+// c, which hands over to the reconnect loop.
+func (ac *AutoClient) heartbeat(c *Connection, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-ticker.C:
+			var pong string
+			err := c.CallWithResult("Ping", nil, 5*time.Second, &pong)
+			if err != nil {
+				log.Println("[heartbeat] failed:", err)
+				c.closeWithReason(fmt.Errorf("heartbeat failed: %w", err))
 				return
-			case <-time.After(interval):
-				value := ac.activeConn.Load()
-				if value == nil {
-					continue
-				}
-				conn := value.(*Connection)
-
-				var pong string
-				err := conn.CallWithResult("Ping", nil, 5*time.Second, &pong)
-				if err != nil {
-					log.Println("[heartbeat] failed:", err)
-
-					// Close the connection to trigger reconnection
-					conn.Conn.Close()
-					ac.activeConn.Store(nil)
-				}
 			}
 		}
-	}()
+	}
 }
@@ -1,19 +1,31 @@
 package bidirpc_test
 
 import (
+	"bytes"
+	"context"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/tls"
 	"crypto/x509"
 	"crypto/x509/pkix"
+	"encoding/binary"
 	"encoding/pem"
 	"errors"
+	"fmt"
+	"io"
 	"log"
 	"math/big"
+	"net"
+	"net/url"
+	"slices"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/golang-jwt/jwt/v5"
 	"github.com/pablolagos/bidirpc"
+	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"github.com/stretchr/testify/suite"
 )
@@ -35,6 +47,10 @@ func (s *BidiRPCServerSuite) SetupSuite() {
 	s.client = s.startClient()
 }
 
+func (s *BidiRPCServerSuite) TearDownSuite() {
+	require.NoError(s.T(), s.server.Close(), "server.Close")
+}
+
 // In order for 'go test' to run this suite, we need to create
 // a normal test function and pass our suite to suite.Run
 func TestBidiRPCServerSuite(t *testing.T) {
@@ -96,6 +112,16 @@ func (s *BidiRPCServerSuite) TestEchoClientServer() {
 	require.Equal(s.T(), "ping", reply, "unexpected reply")
 }
 
+// Test calling echo method form client with a context
+func (s *BidiRPCServerSuite) TestEchoClientServerContext() {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	var reply string
+	err := s.client.CallWithResultContext(ctx, "Echo", map[string]any{"msg": "ping"}, &reply)
+	require.NoError(s.T(), err, "CallWithResultContext")
+	require.Equal(s.T(), "ping", reply, "unexpected reply")
+}
+
 // Test calling divide method form client with a normal result
 func (s *BidiRPCServerSuite) TestDivideClientServer() {
 	var reply int
@@ -141,6 +167,9 @@ func Test_RealServerAndClient_Integration(t *testing.T) {
 	server := bidirpc.NewServer(func(id, code string) bool {
 		return id == clientID && code == authCode
 	})
+	server.RegisterHandler("Echo", func(ctx *bidirpc.Context) {
+		ctx.WriteResponse(ctx.GetParamString("msg", ""))
+	})
 
 	ln, err := tls.Listen("tcp", addr, tlsConfig)
 	if err != nil {
@@ -188,6 +217,7 @@ func Test_RealServerAndClient_Integration(t *testing.T) {
 	if err := client.Start(); err != nil {
 		t.Fatal("client failed to connect:", err)
 	}
+	defer client.Stop()
 
 	// Wait for onReady to run
 	var retries int
@@ -209,6 +239,1455 @@ func Test_RealServerAndClient_Integration(t *testing.T) {
 	}
 }
 
+func Test_ServerShutdownWaitsForHandlers(t *testing.T) {
+	server := bidirpc.NewServer(func(id, code string) bool { return code == "s3cr3t" })
+	started := make(chan struct{})
+	server.RegisterHandler("Slow", func(ctx *bidirpc.Context) {
+		close(started)
+		time.Sleep(200 * time.Millisecond)
+		ctx.WriteResponse("done")
+	})
+	addr, serveErr := startTestServer(t, server)
+
+	conn := dialTestClient(t, addr, "client1", "s3cr3t")
+	result := make(chan error, 1)
+	var reply string
+	go func() {
+		result <- conn.CallWithResult("Slow", nil, 5*time.Second, &reply)
+	}()
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	require.NoError(t, server.Shutdown(ctx), "Shutdown")
+	require.NoError(t, <-result, "in-flight call")
+	require.Equal(t, "done", reply)
+	require.ErrorIs(t, <-serveErr, bidirpc.ErrServerClosed)
+
+	_, err := net.DialTimeout("tcp", addr, time.Second)
+	require.Error(t, err, "listener should be closed")
+}
+
+func Test_ServerShutdownCancelsHandlersOnDeadline(t *testing.T) {
+	server := bidirpc.NewServer(func(id, code string) bool { return code == "s3cr3t" })
+	started := make(chan struct{})
+	cancelled := make(chan struct{})
+	server.RegisterHandler("Block", func(ctx *bidirpc.Context) {
+		close(started)
+		<-ctx.Context().Done()
+		close(cancelled)
+	})
+	addr, _ := startTestServer(t, server)
+
+	conn := dialTestClient(t, addr, "client1", "s3cr3t")
+	conn.CallAsync("Block", nil, 5*time.Second, nil)
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	require.ErrorIs(t, server.Shutdown(ctx), context.DeadlineExceeded)
+
+	select {
+	case <-cancelled:
+	case <-time.After(time.Second):
+		t.Fatal("handler was not cancelled")
+	}
+}
+
+func Test_CallContextDeadline(t *testing.T) {
+	server := bidirpc.NewServer(func(id, code string) bool { return code == "s3cr3t" })
+	server.RegisterHandler("Block", func(ctx *bidirpc.Context) {
+		<-ctx.Context().Done()
+	})
+	addr, _ := startTestServer(t, server)
+	conn := dialTestClient(t, addr, "client1", "s3cr3t")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	_, err := conn.CallContext(ctx, "Block", nil)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	_, err = conn.CallContext(ctx, "Block", nil)
+	require.ErrorIs(t, err, context.Canceled)
+}
+
+func Test_CancelPropagatesToHandler(t *testing.T) {
+	server := bidirpc.NewServer(func(id, code string) bool { return code == "s3cr3t" })
+	started := make(chan struct{})
+	cancelled := make(chan struct{})
+	server.RegisterHandler("Block", func(ctx *bidirpc.Context) {
+		close(started)
+		<-ctx.Done()
+		close(cancelled)
+	})
+	addr, _ := startTestServer(t, server)
+	conn := dialTestClient(t, addr, "client1", "s3cr3t")
+
+	call := conn.CallAsync("Block", nil, 5*time.Second, nil)
+	<-started
+	call.Cancel()
+
+	select {
+	case <-cancelled:
+	case <-time.After(2 * time.Second):
+		t.Fatal("remote handler was not cancelled")
+	}
+}
+
+func Test_MiddlewareAndInterceptors(t *testing.T) {
+	server := bidirpc.NewServer(func(id, code string) bool { return code == "s3cr3t" })
+	var order []string
+	trace := func(name string) bidirpc.Middleware {
+		return func(next bidirpc.HandlerFunc) bidirpc.HandlerFunc {
+			return func(ctx *bidirpc.Context) {
+				order = append(order, name)
+				next(ctx)
+			}
+		}
+	}
+	server.RegisterHandler("Echo", func(ctx *bidirpc.Context) {
+		order = append(order, "handler")
+		ctx.WriteResponse(ctx.GetParamString("msg", ""))
+	}, trace("method"))
+	server.Use(trace("outer"), trace("inner"))
+	addr, _ := startTestServer(t, server)
+
+	conn := dialTestClient(t, addr, "client1", "s3cr3t")
+	var calls []string
+	conn.UseInterceptor(func(next bidirpc.Invoker) bidirpc.Invoker {
+		return func(ctx context.Context, method string, params map[string]any) (any, error) {
+			calls = append(calls, method)
+			return next(ctx, method, map[string]any{"msg": "intercepted"})
+		}
+	})
+
+	var reply string
+	require.NoError(t, conn.CallWithResult("Echo", nil, 5*time.Second, &reply))
+	require.Equal(t, "intercepted", reply)
+	require.Equal(t, []string{"Echo"}, calls)
+	require.Equal(t, []string{"outer", "inner", "method", "handler"}, order)
+
+	// Interceptors added to one connection leave the owner's other
+	// connections alone.
+	var serverCalls []string
+	record := func(name string) bidirpc.Interceptor {
+		return func(next bidirpc.Invoker) bidirpc.Invoker {
+			return func(ctx context.Context, method string, params map[string]any) (any, error) {
+				serverCalls = append(serverCalls, name+" "+method)
+				return next(ctx, method, params)
+			}
+		}
+	}
+	server.UseInterceptor(record("server"))
+	dialTestClient(t, addr, "client2", "s3cr3t")
+	require.Eventually(t, func() bool { return len(server.ListClientIDs()) == 2 }, time.Second, 10*time.Millisecond)
+	server.GetClientByID("client1").UseInterceptor(record("client1"))
+	_, _ = server.Call("client1", "Reload", nil, time.Second)
+	_, _ = server.Call("client2", "Reload", nil, time.Second)
+	require.Equal(t, []string{"server Reload", "client1 Reload", "server Reload"}, serverCalls)
+}
+
+func Test_HandlerPanicIsRecovered(t *testing.T) {
+	server := bidirpc.NewServer(func(id, code string) bool { return code == "s3cr3t" })
+	server.RegisterHandler("Boom", func(ctx *bidirpc.Context) {
+		panic("boom")
+	})
+	server.RegisterHandler("Echo", func(ctx *bidirpc.Context) {
+		ctx.WriteResponse(ctx.GetParamString("msg", ""))
+	})
+	server.RegisterHandler("ReplyThenBoom", func(ctx *bidirpc.Context) {
+		ctx.WriteResponse("done")
+		panic("late")
+	})
+	hook := make(chan any, 1)
+	server.OnPanic(func(ctx *bidirpc.Context, recovered any, stack []byte) {
+		assert.NotEmpty(t, stack, "stack trace")
+		hook <- recovered
+	})
+	addr, _ := startTestServer(t, server)
+	conn := dialTestClient(t, addr, "client1", "s3cr3t")
+
+	_, err := conn.Call("Boom", nil, 5*time.Second)
+	var respErr *bidirpc.ResponseError
+	require.ErrorAs(t, err, &respErr)
+	require.Equal(t, bidirpc.ErrCodeHandlerPanic, respErr.Code)
+	require.Equal(t, "boom", <-hook)
+
+	var reply string
+	require.NoError(t, conn.CallWithResult("Echo", map[string]any{"msg": "alive"}, 5*time.Second, &reply))
+	require.Equal(t, "alive", reply)
+
+	// A panic after the response was sent must not answer the call twice.
+	raw, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer raw.Close()
+	late := bidirpc.NewConnection(raw)
+	require.NoError(t, late.SendNegotiation(bidirpc.NegotiationMessage{Type: bidirpc.AuthRequestType, ClientID: "raw", AuthCode: "s3cr3t"}))
+	var resp bidirpc.NegotiationMessage
+	require.NoError(t, late.ReceiveNegotiation(&resp))
+	require.NoError(t, late.Send(bidirpc.RPCMessage{Type: bidirpc.RequestType, ID: "1", Method: "ReplyThenBoom"}))
+	var msg bidirpc.RPCMessage
+	require.NoError(t, late.Dec.Decode(&msg))
+	require.Equal(t, "done", msg.Result)
+	require.Equal(t, "late", <-hook)
+	require.NoError(t, raw.SetReadDeadline(time.Now().Add(100*time.Millisecond)))
+	var extra bidirpc.RPCMessage
+	require.Error(t, late.Dec.Decode(&extra), "second response: %+v", extra)
+}
+
+type addArgs struct {
+	A int64 `json:"a"`
+	B int64 `json:"b"`
+}
+
+type addReply struct {
+	Sum int64 `json:"sum"`
+}
+
+func Test_TypedHandleAndInvoke(t *testing.T) {
+	server := bidirpc.NewServer(func(id, code string) bool { return code == "s3cr3t" })
+	bidirpc.Handle(server.Handlers(), "Add", func(ctx *bidirpc.Context, req addArgs) (addReply, error) {
+		if req.A < 0 {
+			return addReply{}, &bidirpc.ResponseError{Code: 42, Message: "negative"}
+		}
+		return addReply{Sum: req.A + req.B}, nil
+	})
+	addr, _ := startTestServer(t, server)
+	conn := dialTestClient(t, addr, "client1", "s3cr3t")
+
+	reply, err := bidirpc.Invoke[addArgs, addReply](context.Background(), conn, "Add", addArgs{A: 2, B: 3})
+	require.NoError(t, err)
+	require.Equal(t, int64(5), reply.Sum)
+
+	_, err = bidirpc.Invoke[addArgs, addReply](context.Background(), conn, "Add", addArgs{A: -1})
+	var respErr *bidirpc.ResponseError
+	require.ErrorAs(t, err, &respErr)
+	require.Equal(t, 42, respErr.Code)
+}
+
+type Arith struct{}
+
+func (a *Arith) Add(ctx *bidirpc.Context, args *addArgs, reply *addReply) error {
+	reply.Sum = args.A + args.B
+	return nil
+}
+
+func (a *Arith) Fail(ctx *bidirpc.Context, args addArgs, reply *addReply) error {
+	return errors.New("always fails")
+}
+
+// NotAService has the wrong signature and must be skipped.
+func (a *Arith) NotAService(x int) int { return x }
+
+func Test_RegisterService(t *testing.T) {
+	server := bidirpc.NewServer(func(id, code string) bool { return code == "s3cr3t" })
+	require.NoError(t, server.RegisterService("Arith", &Arith{}))
+	require.Error(t, server.RegisterService("Empty", &struct{}{}))
+	addr, _ := startTestServer(t, server)
+	conn := dialTestClient(t, addr, "client1", "s3cr3t")
+
+	var reply addReply
+	require.NoError(t, conn.CallWithResult("Arith.Add", map[string]any{"a": 4, "b": 5}, 5*time.Second, &reply))
+	require.Equal(t, int64(9), reply.Sum)
+
+	_, err := conn.Call("Arith.Fail", nil, 5*time.Second)
+	var respErr *bidirpc.ResponseError
+	require.ErrorAs(t, err, &respErr)
+	require.Equal(t, bidirpc.ErrCodeInternal, respErr.Code)
+	require.Equal(t, "always fails", respErr.Message)
+
+	_, err = conn.Call("Arith.NotAService", nil, 5*time.Second)
+	require.ErrorAs(t, err, &respErr)
+	require.Equal(t, bidirpc.ErrCodeMethodNotFound, respErr.Code)
+}
+
+func Test_Codecs(t *testing.T) {
+	server := bidirpc.NewServer(func(id, code string) bool { return code == "s3cr3t" })
+	bidirpc.Handle(server.Handlers(), "Add", func(ctx *bidirpc.Context, req addArgs) (addReply, error) {
+		return addReply{Sum: req.A + req.B}, nil
+	})
+	server.RegisterHandler("Codec", func(ctx *bidirpc.Context) {
+		ctx.WriteResponse(ctx.GetParamInt("n", 0))
+	})
+	addr, _ := startTestServer(t, server)
+
+	for _, name := range []string{bidirpc.CodecJSON, bidirpc.CodecMsgPack, bidirpc.CodecCBOR} {
+		t.Run(name, func(t *testing.T) {
+			conn := dialTestClientWith(t, addr, bidirpc.NegotiationMessage{
+				Type:     bidirpc.AuthRequestType,
+				ClientID: "client-" + name,
+				AuthCode: "s3cr3t",
+				Version:  bidirpc.ProtocolVersion,
+				Capabilities: &bidirpc.Capabilities{
+					Codecs:      []string{name, bidirpc.CodecJSON},
+					Compression: []string{bidirpc.CompressionGzip},
+				},
+			})
+			require.Equal(t, name, conn.Codec().Name())
+
+			var n int
+			require.NoError(t, conn.CallWithResult("Codec", map[string]any{"n": 7}, 5*time.Second, &n))
+			require.Equal(t, 7, n)
+
+			if name == bidirpc.CodecJSON {
+				return // JSON cannot carry int64 beyond 2^53
+			}
+			big := int64(1)<<60 + 1
+			reply, err := bidirpc.Invoke[addArgs, addReply](context.Background(), conn, "Add", addArgs{A: big, B: 1})
+			require.NoError(t, err)
+			require.Equal(t, big+1, reply.Sum)
+		})
+	}
+}
+
+func Test_FramingSkipsBadFrames(t *testing.T) {
+	server := bidirpc.NewServer(func(id, code string) bool { return code == "s3cr3t" })
+	server.SetMaxFrameSize(4096)
+	server.RegisterHandler("Echo", func(ctx *bidirpc.Context) {
+		ctx.WriteResponse(ctx.GetParamString("msg", ""))
+	})
+	server.RegisterHandler("Dump", func(ctx *bidirpc.Context) {
+		noise := make([]byte, 8192)
+		_, _ = rand.Read(noise)
+		ctx.WriteResponse(noise)
+	})
+	addr, _ := startTestServer(t, server)
+	conn := dialTestClientWith(t, addr, bidirpc.NegotiationMessage{
+		Type:     bidirpc.AuthRequestType,
+		ClientID: "client1",
+		AuthCode: "s3cr3t",
+		Version:  bidirpc.ProtocolVersion,
+		Capabilities: &bidirpc.Capabilities{
+			Compression: []string{bidirpc.CompressionGzip},
+			Framing:     true,
+		},
+	})
+
+	writeFrame := func(id string, payload []byte) {
+		frame := binary.BigEndian.AppendUint32(nil, uint32(4+len(id)+len(payload)))
+		frame = append(frame, 0, 1) // flags, request type
+		frame = binary.BigEndian.AppendUint16(frame, uint16(len(id)))
+		frame = append(frame, id...)
+		frame = append(frame, payload...)
+		_, err := conn.Conn.Write(frame)
+		require.NoError(t, err)
+	}
+	writeFrame("bad", []byte("{not json"))
+
+	// The agreed limit is also enforced before sending.
+	noise := make([]byte, 8192)
+	_, _ = rand.Read(noise)
+	_, err := conn.Call("Echo", map[string]any{"msg": noise}, 5*time.Second)
+	require.ErrorIs(t, err, bidirpc.ErrFrameTooLarge)
+
+	// So is a response too large for the client, which gets an error instead.
+	_, err = conn.Call("Dump", nil, 5*time.Second)
+	var respErr *bidirpc.ResponseError
+	require.ErrorAs(t, err, &respErr)
+	require.Equal(t, bidirpc.ErrCodeTooLarge, respErr.Code)
+
+	var reply string
+	require.NoError(t, conn.CallWithResult("Echo", map[string]any{"msg": "still here"}, 5*time.Second, &reply))
+	require.Equal(t, "still here", reply)
+
+	// A frame over the limit is not drained: the server hangs up.
+	frame := binary.BigEndian.AppendUint32(nil, 1<<30)
+	frame = append(frame, 0, 1, 0, 3)
+	frame = append(frame, "big"...)
+	_, err = conn.Conn.Write(frame)
+	require.NoError(t, err)
+	select {
+	case <-conn.Done():
+	case <-time.After(2 * time.Second):
+		t.Fatal("connection survived an oversized frame")
+	}
+}
+
+func Test_OversizedNegotiationIsRejected(t *testing.T) {
+	server := bidirpc.NewServer(func(id, code string) bool { return true })
+	addr, _ := startTestServer(t, server)
+
+	raw, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer raw.Close()
+	go raw.Write(bytes.Repeat([]byte("x"), 1<<20)) // no newline in sight
+
+	require.NoError(t, raw.SetReadDeadline(time.Now().Add(2*time.Second)))
+	_, err = raw.Read(make([]byte, 1))
+	var netErr net.Error
+	require.Error(t, err)
+	require.False(t, errors.As(err, &netErr) && netErr.Timeout(), "server kept reading: %v", err)
+}
+
+func Test_CapabilityNegotiation(t *testing.T) {
+	server := bidirpc.NewServer(func(id, code string) bool { return code == "s3cr3t" })
+	server.SetCodecs(bidirpc.CodecCBOR)
+	server.SetMaxFrameSize(1 << 20)
+	server.RegisterHandler("Echo", func(ctx *bidirpc.Context) {
+		ctx.WriteResponse(ctx.GetParamString("msg", ""))
+	})
+	addr, _ := startTestServer(t, server)
+
+	conn := dialTestClientWith(t, addr, bidirpc.NegotiationMessage{
+		Type:     bidirpc.AuthRequestType,
+		ClientID: "client1",
+		AuthCode: "s3cr3t",
+		Version:  bidirpc.ProtocolVersion,
+		Capabilities: &bidirpc.Capabilities{
+			Codecs:         []string{bidirpc.CodecMsgPack, bidirpc.CodecCBOR},
+			Compression:    []string{"zstd", bidirpc.CompressionGzip},
+			Framing:        true,
+			Cancellation:   true,
+			MaxMessageSize: 1 << 30,
+		},
+	})
+	require.Equal(t, bidirpc.ProtocolVersion, conn.ProtocolVersion())
+	require.Equal(t, bidirpc.Capabilities{
+		Codecs:         []string{bidirpc.CodecCBOR},
+		Compression:    []string{bidirpc.CompressionGzip},
+		Framing:        true,
+		Cancellation:   true,
+		MaxMessageSize: 1 << 20,
+	}, conn.Capabilities())
+
+	var reply string
+	require.NoError(t, conn.CallWithResult("Echo", map[string]any{"msg": "hi"}, 5*time.Second, &reply))
+	require.Equal(t, "hi", reply)
+
+	// A version 1 client only knows about UseCompression.
+	legacy := dialTestClientWith(t, addr, bidirpc.NegotiationMessage{
+		Type:           bidirpc.AuthRequestType,
+		ClientID:       "legacy",
+		AuthCode:       "s3cr3t",
+		UseCompression: true,
+	})
+	require.Equal(t, 1, legacy.ProtocolVersion())
+	require.False(t, legacy.Capabilities().Cancellation)
+	require.NoError(t, legacy.CallWithResult("Echo", map[string]any{"msg": "old"}, 5*time.Second, &reply))
+	require.Equal(t, "old", reply)
+	require.ErrorIs(t, server.Notify("legacy", "Echo", nil), bidirpc.ErrNotificationsUnsupported)
+	require.ErrorIs(t, server.Broadcast("Echo", nil), bidirpc.ErrNotificationsUnsupported)
+	require.ErrorIs(t, legacy.Subscribe("news", func(*bidirpc.Context, any) {}), bidirpc.ErrNotificationsUnsupported)
+}
+
+func Test_ServerStreaming(t *testing.T) {
+	server := bidirpc.NewServer(func(id, code string) bool { return code == "s3cr3t" })
+	server.RegisterHandler("Count", func(ctx *bidirpc.Context) {
+		n := ctx.GetParamInt("n", 0)
+		for i := 0; i < n; i++ {
+			if err := ctx.Send(i); err != nil {
+				return
+			}
+		}
+		if ctx.GetParamString("fail", "") != "" {
+			ctx.Close(&bidirpc.ResponseError{Code: 42, Message: "failed"})
+			return
+		}
+		ctx.Close(nil)
+	})
+	stopped := make(chan struct{})
+	server.RegisterHandler("Forever", func(ctx *bidirpc.Context) {
+		defer close(stopped)
+		for i := 0; ctx.Send(i) == nil; i++ {
+			time.Sleep(time.Millisecond)
+		}
+	})
+	server.RegisterHandler("Forgetful", func(ctx *bidirpc.Context) {
+		ctx.Send("only")
+	})
+	server.RegisterHandler("Later", func(ctx *bidirpc.Context) {
+		go func() {
+			time.Sleep(20 * time.Millisecond)
+			ctx.WriteResponse("late")
+		}()
+	})
+	flooded := make(chan struct{})
+	server.RegisterHandler("Flood", func(ctx *bidirpc.Context) {
+		defer close(flooded)
+		for i := 0; ctx.Send(i) == nil; i++ {
+		}
+	})
+	addr, _ := startTestServer(t, server)
+	conn := dialTestClient(t, addr, "client1", "s3cr3t")
+	ctx := context.Background()
+
+	stream, err := conn.CallStream(ctx, "Count", map[string]any{"n": 5})
+	require.NoError(t, err)
+	var got []int
+	for item, err := range stream.All() {
+		require.NoError(t, err)
+		got = append(got, int(item.(float64)))
+	}
+	require.Equal(t, []int{0, 1, 2, 3, 4}, got)
+
+	stream, err = conn.CallStream(ctx, "Count", map[string]any{"n": 1, "fail": "yes"})
+	require.NoError(t, err)
+	var n int
+	require.NoError(t, stream.RecvInto(&n))
+	_, err = stream.Recv()
+	var respErr *bidirpc.ResponseError
+	require.ErrorAs(t, err, &respErr)
+	require.Equal(t, 42, respErr.Code)
+
+	stream, err = conn.CallStream(ctx, "Forever", nil)
+	require.NoError(t, err)
+	_, err = stream.Recv()
+	require.NoError(t, err)
+	stream.Close()
+	select {
+	case <-stopped:
+	case <-time.After(2 * time.Second):
+		t.Fatal("streaming handler was not cancelled")
+	}
+
+	// Returning from the handler ends the stream.
+	stream, err = conn.CallStream(ctx, "Forgetful", nil)
+	require.NoError(t, err)
+	items := 0
+	for _, err := range stream.All() {
+		require.NoError(t, err)
+		items++
+	}
+	require.Equal(t, 1, items)
+
+	// A handler that never streamed may still answer after returning.
+	res, err := conn.Call("Later", nil, time.Second)
+	require.NoError(t, err)
+	require.Equal(t, "late", res)
+
+	// A caller that does not keep up loses the stream instead of buffering
+	// without bound, and the handler is cancelled.
+	stream, err = conn.CallStream(ctx, "Flood", nil)
+	require.NoError(t, err)
+	select {
+	case <-flooded:
+	case <-time.After(5 * time.Second):
+		t.Fatal("flooding handler was not cancelled")
+	}
+	_, err = stream.Recv()
+	require.ErrorIs(t, err, bidirpc.ErrStreamOverflow)
+	stream.Close()
+}
+
+func Test_BidirectionalStream(t *testing.T) {
+	server := bidirpc.NewServer(func(id, code string) bool { return code == "s3cr3t" })
+	server.RegisterStreamHandler("Sum", func(ctx *bidirpc.Context, stream *bidirpc.Stream) error {
+		sum := 0
+		for {
+			var n int
+			err := stream.RecvInto(&n)
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			if err != nil {
+				return err
+			}
+			if n < 0 {
+				return &bidirpc.ResponseError{Code: 422, Message: "negative"}
+			}
+			sum += n
+			if err := stream.Send(sum); err != nil {
+				return err
+			}
+		}
+		return stream.Send(fmt.Sprintf("total %d", sum))
+	})
+	server.Use(func(next bidirpc.HandlerFunc) bidirpc.HandlerFunc {
+		return func(ctx *bidirpc.Context) {
+			if ctx.GetParamString("skip", "") == "" {
+				next(ctx)
+			}
+		}
+	})
+	addr, _ := startTestServer(t, server)
+	conn := dialTestClient(t, addr, "client1", "s3cr3t")
+	ctx := context.Background()
+
+	stream, err := conn.OpenStream(ctx, "Sum", nil)
+	require.NoError(t, err)
+	defer stream.Close()
+	var got []any
+	for _, n := range []int{1, 2, 3} {
+		require.NoError(t, stream.Send(n))
+		item, err := stream.Recv()
+		require.NoError(t, err)
+		got = append(got, item)
+	}
+	require.NoError(t, stream.CloseSend())
+	for item, err := range stream.All() {
+		require.NoError(t, err)
+		got = append(got, item)
+	}
+	require.Equal(t, []any{1.0, 3.0, 6.0, "total 6"}, got)
+	require.ErrorIs(t, stream.Send(4), io.EOF)
+
+	// Only the handler ends a stream; a response from the opener is ignored.
+	stream, err = conn.OpenStream(ctx, "Sum", nil)
+	require.NoError(t, err)
+	defer stream.Close()
+	require.NoError(t, conn.Send(bidirpc.RPCMessage{Type: bidirpc.ResponseType, ID: stream.ID}))
+	require.NoError(t, stream.Send(5))
+	item, err := stream.Recv()
+	require.NoError(t, err)
+	require.Equal(t, 5.0, item)
+	require.NoError(t, stream.CloseSend())
+	item, err = stream.Recv()
+	require.NoError(t, err)
+	require.Equal(t, "total 5", item)
+
+	stream, err = conn.OpenStream(ctx, "Sum", nil)
+	require.NoError(t, err)
+	defer stream.Close()
+	require.NoError(t, stream.Send(-1))
+	_, err = stream.Recv()
+	var respErr *bidirpc.ResponseError
+	require.ErrorAs(t, err, &respErr)
+	require.Equal(t, 422, respErr.Code)
+
+	stream, err = conn.OpenStream(ctx, "Missing", nil)
+	require.NoError(t, err)
+	defer stream.Close()
+	_, err = stream.Recv()
+	require.ErrorAs(t, err, &respErr)
+	require.Equal(t, bidirpc.ErrCodeMethodNotFound, respErr.Code)
+
+	// A middleware that does not call the handler still ends the stream.
+	timeout, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+	stream, err = conn.OpenStream(timeout, "Sum", map[string]any{"skip": "yes"})
+	require.NoError(t, err)
+	defer stream.Close()
+	_, err = stream.Recv()
+	require.ErrorIs(t, err, io.EOF)
+}
+
+func Test_Notify(t *testing.T) {
+	server := bidirpc.NewServer(func(id, code string) bool { return code == "s3cr3t" })
+	events := make(chan string, 10)
+	server.RegisterHandler("Status", func(ctx *bidirpc.Context) {
+		assert.True(t, ctx.IsNotification())
+		events <- ctx.GetParamString("state", "")
+		ctx.WriteResponse("ignored")
+	})
+	server.RegisterHandler("Echo", func(ctx *bidirpc.Context) {
+		assert.False(t, ctx.IsNotification())
+		ctx.WriteResponse(ctx.GetParamString("msg", ""))
+	})
+	addr, _ := startTestServer(t, server)
+
+	for _, framing := range []bool{false, true} {
+		conn := dialTestClientWith(t, addr, bidirpc.NegotiationMessage{
+			Type:         bidirpc.AuthRequestType,
+			ClientID:     "client1",
+			AuthCode:     "s3cr3t",
+			Version:      bidirpc.ProtocolVersion,
+			Capabilities: &bidirpc.Capabilities{Framing: framing},
+		})
+		require.NoError(t, conn.Notify("Status", map[string]any{"state": "up"}))
+		require.NoError(t, conn.Notify("Missing", nil))
+		require.NoError(t, conn.Notify("Status", map[string]any{"state": "down"}))
+		// Handlers run concurrently, so the order is not guaranteed.
+		require.ElementsMatch(t, []string{"up", "down"}, []string{<-events, <-events})
+
+		// The connection is still in sync after the discarded reply.
+		res, err := conn.Call("Echo", map[string]any{"msg": "hi"}, time.Second)
+		require.NoError(t, err)
+		require.Equal(t, "hi", res)
+	}
+}
+
+func Test_BroadcastAndMulticast(t *testing.T) {
+	server := bidirpc.NewServer(func(id, code string) bool { return code == "s3cr3t" })
+	addr, _ := startTestServer(t, server)
+	dialTestClient(t, addr, "b", "s3cr3t")
+	dialTestClient(t, addr, "a", "s3cr3t")
+	require.Eventually(t, func() bool { return len(server.ListClientIDs()) == 2 }, time.Second, 10*time.Millisecond)
+	require.Equal(t, []string{"a", "b"}, server.ListClientIDs())
+
+	require.NoError(t, server.Broadcast("ConfigChanged", map[string]any{"v": 2}))
+
+	// The test clients register no handlers, so every connected client
+	// answers with its own "method not found".
+	results := server.Multicast([]string{"a", "b", "gone"}, "Reload", nil, time.Second)
+	require.Len(t, results, 3)
+	for _, id := range []string{"a", "b"} {
+		var respErr *bidirpc.ResponseError
+		require.ErrorAs(t, results[id].Err, &respErr, id)
+		require.Equal(t, bidirpc.ErrCodeMethodNotFound, respErr.Code)
+	}
+	require.ErrorContains(t, results["gone"].Err, "not connected")
+}
+
+func Test_ClientGroups(t *testing.T) {
+	server := bidirpc.NewServer(func(id, code string) bool { return code == "s3cr3t" })
+	addr, _ := startTestServer(t, server)
+	dialTestClient(t, addr, "a", "s3cr3t")
+	b := dialTestClient(t, addr, "b", "s3cr3t")
+	require.Eventually(t, func() bool { return len(server.ListClientIDs()) == 2 }, time.Second, 10*time.Millisecond)
+
+	require.NoError(t, server.JoinGroup("a", "eu"))
+	require.NoError(t, server.JoinGroup("b", "eu"))
+	require.NoError(t, server.JoinGroup("b", "us"))
+	require.Error(t, server.JoinGroup("nobody", "eu"))
+	require.Equal(t, []string{"a", "b"}, server.GroupMembers("eu"))
+
+	require.NoError(t, server.NotifyGroup("eu", "ConfigChanged", nil))
+	results := server.CallGroup("eu", "Reload", nil, time.Second)
+	require.Len(t, results, 2)
+
+	server.LeaveGroup("a", "eu")
+	require.Equal(t, []string{"b"}, server.GroupMembers("eu"))
+
+	// Disconnecting removes the client from all of its groups.
+	b.Close()
+	require.Eventually(t, func() bool {
+		return len(server.GroupMembers("eu")) == 0 && len(server.GroupMembers("us")) == 0
+	}, 2*time.Second, 10*time.Millisecond)
+}
+
+func Test_PublishSubscribe(t *testing.T) {
+	server := bidirpc.NewServer(func(id, code string) bool { return code == "s3cr3t" })
+	alerts := make(chan string, 10)
+	server.Subscribe("alerts", func(ctx *bidirpc.Context, payload any) {
+		alerts <- ctx.ClientID() + ":" + payload.(string)
+	})
+	addr, _ := startTestServer(t, server)
+	a := dialTestClient(t, addr, "a", "s3cr3t")
+	b := dialTestClient(t, addr, "b", "s3cr3t")
+
+	// Client to server: the server subscribed each client on connect.
+	require.Eventually(t, func() bool { return a.PeerSubscribed("alerts") }, time.Second, 10*time.Millisecond)
+	require.NoError(t, a.Publish("alerts", "disk full"))
+	require.Equal(t, "a:disk full", <-alerts)
+
+	// Server to clients: only subscribers receive the publish.
+	news := make(chan any, 10)
+	require.NoError(t, a.Subscribe("news", func(ctx *bidirpc.Context, payload any) {
+		news <- payload
+	}))
+	require.Eventually(t, func() bool {
+		return slices.Equal(server.Subscribers("news"), []string{"a"})
+	}, time.Second, 10*time.Millisecond)
+	require.NoError(t, server.Publish("news", "hello"))
+	require.Equal(t, "hello", <-news)
+	require.False(t, b.PeerSubscribed("news"))
+
+	require.NoError(t, a.Unsubscribe("news"))
+	require.Eventually(t, func() bool { return len(server.Subscribers("news")) == 0 }, time.Second, 10*time.Millisecond)
+	require.NoError(t, server.Publish("news", "again"))
+	select {
+	case got := <-news:
+		t.Fatalf("unexpected publish after unsubscribe: %v", got)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func Test_LifecycleHooks(t *testing.T) {
+	server := bidirpc.NewServer(func(id, code string) bool { return code == "s3cr3t" })
+	events := make(chan string, 20)
+	server.OnConnect(func(c *bidirpc.Connection) { events <- "server connect " + c.ClientID() })
+	server.OnDisconnect(func(c *bidirpc.Connection, reason error) {
+		assert.Error(t, reason)
+		events <- "server disconnect " + c.ClientID()
+	})
+	server.OnAuthFailed(func(clientID string, addr net.Addr, err error) {
+		assert.ErrorIs(t, err, bidirpc.ErrAuthFailed)
+		events <- "server auth failed " + clientID
+	})
+	addr, _ := startTestServer(t, server)
+
+	client := bidirpc.NewAutoClient(addr, "agent", "s3cr3t", false, nil, "", false, nil)
+	client.OnConnect(func(c *bidirpc.Connection) { events <- "client connect" })
+	client.OnDisconnect(func(c *bidirpc.Connection, reason error) { events <- "client disconnect" })
+	client.OnReconnecting(func(attempt int) { events <- fmt.Sprint("client reconnecting ", attempt) })
+	require.NoError(t, client.Start())
+
+	next := func() string {
+		select {
+		case e := <-events:
+			return e
+		case <-time.After(2 * time.Second):
+			t.Fatal("timed out waiting for an event")
+			return ""
+		}
+	}
+	require.ElementsMatch(t, []string{"server connect agent", "client connect"}, []string{next(), next()})
+
+	// Dropping the connection on the server is seen by both sides and
+	// followed by exactly one reconnect.
+	server.GetClientByID("agent").Close()
+	require.ElementsMatch(t, []string{
+		"server disconnect agent", "client disconnect", "client reconnecting 1",
+		"server connect agent", "client connect",
+	}, []string{next(), next(), next(), next(), next()})
+
+	client.Stop()
+	require.ElementsMatch(t, []string{"server disconnect agent", "client disconnect"}, []string{next(), next()})
+	require.False(t, client.IsConnected())
+	select {
+	case e := <-events:
+		t.Fatalf("unexpected event after Stop: %s", e)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	bad := bidirpc.NewAutoClient(addr, "intruder", "wrong", false, nil, "", false, nil)
+	authErr := make(chan error, 1)
+	bad.OnAuthFailed(func(err error) { authErr <- err })
+	require.ErrorIs(t, bad.Start(), bidirpc.ErrAuthFailed)
+	require.ErrorIs(t, <-authErr, bidirpc.ErrAuthFailed)
+	require.Equal(t, "server auth failed intruder", next())
+}
+
+func Test_PendingCallsFailOnClose(t *testing.T) {
+	server := bidirpc.NewServer(func(id, code string) bool { return code == "s3cr3t" })
+	started := make(chan struct{}, 2)
+	server.RegisterHandler("Hang", func(ctx *bidirpc.Context) {
+		started <- struct{}{}
+		<-ctx.Done()
+	})
+	server.RegisterHandler("HangStream", func(ctx *bidirpc.Context) {
+		ctx.Send("first")
+		<-ctx.Done()
+	})
+	addr, _ := startTestServer(t, server)
+	conn := dialTestClient(t, addr, "client1", "s3cr3t")
+	require.NoError(t, conn.Err())
+
+	stream, err := conn.CallStream(context.Background(), "HangStream", nil)
+	require.NoError(t, err)
+	_, err = stream.Recv()
+	require.NoError(t, err)
+
+	errs := make(chan error, 1)
+	go func() {
+		_, err := conn.Call("Hang", nil, time.Minute)
+		errs <- err
+	}()
+	<-started
+
+	server.GetClientByID("client1").Close()
+	select {
+	case err := <-errs:
+		require.ErrorIs(t, err, bidirpc.ErrConnectionClosed)
+		require.ErrorIs(t, err, io.EOF)
+	case <-time.After(2 * time.Second):
+		t.Fatal("pending call was not failed")
+	}
+	<-conn.Done()
+	require.ErrorIs(t, conn.Err(), bidirpc.ErrConnectionClosed)
+	require.ErrorIs(t, conn.Send(bidirpc.RPCMessage{Type: bidirpc.RequestType}), bidirpc.ErrConnectionClosed)
+	_, err = stream.Recv()
+	require.ErrorIs(t, err, bidirpc.ErrConnectionClosed)
+}
+
+func Test_DuplicateClientPolicy(t *testing.T) {
+	newServer := func(policy bidirpc.DuplicatePolicy) (*bidirpc.Server, string, chan bidirpc.DuplicatePolicy) {
+		server := bidirpc.NewServer(func(id, code string) bool { return code == "s3cr3t" })
+		server.SetDuplicatePolicy(policy)
+		events := make(chan bidirpc.DuplicatePolicy, 5)
+		server.OnDuplicateClient(func(existing, newcomer *bidirpc.Connection, policy bidirpc.DuplicatePolicy) {
+			assert.Equal(t, existing.ClientID(), newcomer.ClientID())
+			events <- policy
+		})
+		addr, _ := startTestServer(t, server)
+		return server, addr, events
+	}
+	sessionOf := func(server *bidirpc.Server) string {
+		if c := server.GetClientByID("dup"); c != nil {
+			return c.SessionID()
+		}
+		return ""
+	}
+
+	t.Run("kick old", func(t *testing.T) {
+		server, addr, events := newServer(bidirpc.DuplicateKickOld)
+		reasons := make(chan error, 5)
+		server.OnDisconnect(func(c *bidirpc.Connection, reason error) { reasons <- reason })
+		first := dialTestClient(t, addr, "dup", "s3cr3t")
+		require.Eventually(t, func() bool { return sessionOf(server) == first.SessionID() }, time.Second, 10*time.Millisecond)
+		require.NoError(t, server.JoinGroup("dup", "g"))
+
+		second := dialTestClient(t, addr, "dup", "s3cr3t")
+		require.Equal(t, bidirpc.DuplicateKickOld, <-events)
+		<-first.Done()
+		require.ErrorIs(t, <-reasons, bidirpc.ErrSessionReplaced)
+
+		// The old connection's cleanup leaves the new one in place.
+		require.Equal(t, second.SessionID(), sessionOf(server))
+		require.Equal(t, []string{"dup"}, server.GroupMembers("g"))
+		require.NoError(t, second.Err())
+	})
+
+	t.Run("reject", func(t *testing.T) {
+		server, addr, events := newServer(bidirpc.DuplicateReject)
+		first := dialTestClient(t, addr, "dup", "s3cr3t")
+		require.Eventually(t, func() bool { return sessionOf(server) == first.SessionID() }, time.Second, 10*time.Millisecond)
+
+		raw, err := net.Dial("tcp", addr)
+		require.NoError(t, err)
+		defer raw.Close()
+		conn := bidirpc.NewConnection(raw)
+		require.NoError(t, conn.SendNegotiation(bidirpc.NegotiationMessage{
+			Type: bidirpc.AuthRequestType, ClientID: "dup", AuthCode: "s3cr3t",
+		}))
+		var resp bidirpc.NegotiationMessage
+		require.NoError(t, conn.ReceiveNegotiation(&resp))
+		require.Equal(t, bidirpc.MessageType(bidirpc.AuthFailType), resp.Type)
+		require.NotEmpty(t, resp.Reason)
+		require.Equal(t, bidirpc.DuplicateReject, <-events)
+		require.Equal(t, first.SessionID(), sessionOf(server))
+	})
+
+	t.Run("reject race", func(t *testing.T) {
+		server, addr, events := newServer(bidirpc.DuplicateReject)
+		// Both handshakes pass authentication before either is admitted.
+		var authenticating sync.WaitGroup
+		authenticating.Add(2)
+		server.SetAuthenticator(bidirpc.AuthenticatorFunc(func(ctx context.Context, creds bidirpc.Credentials) (*bidirpc.Identity, error) {
+			authenticating.Done()
+			authenticating.Wait()
+			return &bidirpc.Identity{}, nil
+		}))
+
+		// The loser is refused before it is told that it authenticated.
+		clients := make(chan *bidirpc.AutoClient, 2)
+		results := make(chan error, 2)
+		for range 2 {
+			go func() {
+				client := bidirpc.NewAutoClient(addr, "race", "s3cr3t", false, nil, "", false, nil)
+				clients <- client
+				results <- client.Start()
+			}()
+		}
+		var errs []error
+		for range 2 {
+			defer (<-clients).Stop()
+			if err := <-results; err != nil {
+				errs = append(errs, err)
+			}
+		}
+		require.Len(t, errs, 1)
+		var authErr *bidirpc.AuthError
+		require.ErrorAs(t, errs[0], &authErr)
+		require.Equal(t, "duplicate_client", authErr.Code)
+		require.Equal(t, bidirpc.DuplicateReject, <-events)
+		require.Empty(t, events)
+	})
+
+	t.Run("allow", func(t *testing.T) {
+		server, addr, events := newServer(bidirpc.DuplicateAllow)
+		first := dialTestClient(t, addr, "dup", "s3cr3t")
+		require.Eventually(t, func() bool { return sessionOf(server) == first.SessionID() }, time.Second, 10*time.Millisecond)
+		second := dialTestClient(t, addr, "dup", "s3cr3t")
+		require.Equal(t, bidirpc.DuplicateAllow, <-events)
+
+		require.ElementsMatch(t, []string{first.SessionID(), second.SessionID()}, server.ListSessions("dup"))
+		require.NotNil(t, server.GetSession(first.SessionID()))
+		require.Equal(t, second.SessionID(), sessionOf(server))
+
+		third := dialTestClient(t, addr, "dup", "s3cr3t")
+		require.Equal(t, bidirpc.DuplicateAllow, <-events)
+		require.Equal(t, third.SessionID(), sessionOf(server))
+
+		// The most recent remaining session takes over when the current one leaves.
+		third.Close()
+		require.Eventually(t, func() bool { return sessionOf(server) == second.SessionID() }, time.Second, 10*time.Millisecond)
+		second.Close()
+		require.Eventually(t, func() bool { return sessionOf(server) == first.SessionID() }, time.Second, 10*time.Millisecond)
+		require.Equal(t, []string{first.SessionID()}, server.ListSessions("dup"))
+	})
+}
+
+func Test_Authenticator(t *testing.T) {
+	server := bidirpc.NewServer(nil)
+	server.SetAuthenticator(bidirpc.AuthenticatorFunc(func(ctx context.Context, creds bidirpc.Credentials) (*bidirpc.Identity, error) {
+		switch creds.AuthCode {
+		case "acme-admin":
+			return &bidirpc.Identity{Tenant: "acme", Roles: []string{"admin"}, Claims: map[string]any{"plan": "pro"}}, nil
+		case "expired":
+			return nil, &bidirpc.AuthError{Code: "expired", Message: "token expired"}
+		default:
+			return nil, errors.New("database unavailable")
+		}
+	}))
+	server.RegisterHandler("WhoAmI", func(ctx *bidirpc.Context) {
+		id := ctx.Identity()
+		ctx.WriteResponse(fmt.Sprintf("%s@%s admin=%t plan=%v", id.ClientID, id.Tenant, id.HasRole("admin"), id.Claims["plan"]))
+	})
+	addr, _ := startTestServer(t, server)
+
+	conn := dialTestClient(t, addr, "agent", "acme-admin")
+	res, err := conn.Call("WhoAmI", nil, time.Second)
+	require.NoError(t, err)
+	require.Equal(t, "agent@acme admin=true plan=pro", res)
+
+	// An AuthError reaches the client; other errors stay on the server.
+	client := bidirpc.NewAutoClient(addr, "agent", "expired", false, nil, "", false, nil)
+	err = client.Start()
+	var authErr *bidirpc.AuthError
+	require.ErrorAs(t, err, &authErr)
+	require.Equal(t, "expired", authErr.Code)
+	require.ErrorIs(t, err, bidirpc.ErrAuthFailed)
+
+	client = bidirpc.NewAutoClient(addr, "agent", "other", false, nil, "", false, nil)
+	err = client.Start()
+	require.ErrorIs(t, err, bidirpc.ErrAuthFailed)
+	require.NotErrorAs(t, err, &authErr)
+	require.NotContains(t, err.Error(), "database")
+}
+
+func Test_HMACChallengeResponse(t *testing.T) {
+	secrets := map[string][]byte{"agent": []byte("shared-secret")}
+	server := bidirpc.NewServer(nil)
+	server.SetAuthenticator(bidirpc.HMACAuthenticator(func(ctx context.Context, clientID string) ([]byte, error) {
+		return secrets[clientID], nil
+	}))
+	server.RegisterHandler("Echo", func(ctx *bidirpc.Context) {
+		ctx.WriteResponse(ctx.GetParamString("msg", ""))
+	})
+	addr, _ := startTestServer(t, server)
+
+	// Record what the client puts on the wire.
+	var sent bytes.Buffer
+	var sentMu sync.Mutex
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			in, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			out, err := net.Dial("tcp", addr)
+			if err != nil {
+				in.Close()
+				continue
+			}
+			go io.Copy(in, out)
+			go func() {
+				buf := make([]byte, 4096)
+				for {
+					n, err := in.Read(buf)
+					sentMu.Lock()
+					sent.Write(buf[:n])
+					sentMu.Unlock()
+					if err != nil {
+						out.Close()
+						return
+					}
+					out.Write(buf[:n])
+				}
+			}()
+		}
+	}()
+
+	client := bidirpc.NewAutoClient(ln.Addr().String(), "agent", "", false, nil, "", false, nil)
+	client.UseHMACAuth([]byte("shared-secret"))
+	require.NoError(t, client.Start())
+	defer client.Stop()
+	res, err := client.Call("Echo", map[string]any{"msg": "hi"}, time.Second)
+	require.NoError(t, err)
+	require.Equal(t, "hi", res)
+	sentMu.Lock()
+	require.NotContains(t, sent.String(), "shared-secret")
+	sentMu.Unlock()
+
+	wrong := bidirpc.NewAutoClient(addr, "agent", "", false, nil, "", false, nil)
+	wrong.UseHMACAuth([]byte("guess"))
+	require.ErrorIs(t, wrong.Start(), bidirpc.ErrAuthFailed)
+
+	// A cleartext auth code is refused, even if it is the secret.
+	plain := bidirpc.NewAutoClient(addr, "agent", "shared-secret", false, nil, "", false, nil)
+	var authErr *bidirpc.AuthError
+	require.ErrorAs(t, plain.Start(), &authErr)
+	require.Equal(t, "challenge_required", authErr.Code)
+}
+
+func Test_MutualTLSIdentity(t *testing.T) {
+	caKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	require.NoError(t, err)
+	ca, err := x509.ParseCertificate(caDER)
+	require.NoError(t, err)
+	pool := x509.NewCertPool()
+	pool.AddCert(ca)
+
+	spiffe, _ := url.Parse("spiffe://example.org/agent/42")
+	clientKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	clientDER, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "agent"},
+		URIs:         []*url.URL{spiffe},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, ca, &clientKey.PublicKey, caKey)
+	require.NoError(t, err)
+	clientCert := tls.Certificate{Certificate: [][]byte{clientDER}, PrivateKey: clientKey}
+
+	serve := func(auth bidirpc.Authenticator) string {
+		server := bidirpc.NewServer(nil)
+		server.SetAuthenticator(auth)
+		server.RegisterHandler("WhoAmI", func(ctx *bidirpc.Context) {
+			certs := ctx.PeerCertificates()
+			ctx.WriteResponse(fmt.Sprintf("%s %s", ctx.Identity().ClientID, certs[0].Subject.CommonName))
+		})
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		go server.ServeListener(tls.NewListener(ln, &tls.Config{
+			Certificates: []tls.Certificate{generateSelfSignedCert(t)},
+			ClientAuth:   tls.RequireAndVerifyClientCert,
+			ClientCAs:    pool,
+		}))
+		t.Cleanup(func() { server.Close() })
+		return ln.Addr().String()
+	}
+	connect := func(addr, clientID string) (*bidirpc.AutoClient, error) {
+		client := bidirpc.NewAutoClient(addr, clientID, "", true, &tls.Config{
+			Certificates:       []tls.Certificate{clientCert},
+			InsecureSkipVerify: true,
+		}, "bidirpc", false, nil)
+		err := client.Start()
+		if err == nil {
+			t.Cleanup(client.Stop)
+		}
+		return client, err
+	}
+
+	// The certificate URI replaces whatever ID the client claimed.
+	addr := serve(bidirpc.CertAuthenticator{Name: bidirpc.CertURI})
+	client, err := connect(addr, "anything")
+	require.NoError(t, err)
+	res, err := client.Call("WhoAmI", nil, time.Second)
+	require.NoError(t, err)
+	require.Equal(t, "spiffe://example.org/agent/42 agent", res)
+
+	addr = serve(bidirpc.CertAuthenticator{Name: bidirpc.CertCommonName, RequireMatch: true})
+	_, err = connect(addr, "agent")
+	require.NoError(t, err)
+	_, err = connect(addr, "impostor")
+	var authErr *bidirpc.AuthError
+	require.ErrorAs(t, err, &authErr)
+	require.Equal(t, "certificate_mismatch", authErr.Code)
+}
+
+func Test_AuthorizationPolicies(t *testing.T) {
+	server := bidirpc.NewServer(nil)
+	server.SetAuthenticator(bidirpc.AuthenticatorFunc(func(ctx context.Context, creds bidirpc.Credentials) (*bidirpc.Identity, error) {
+		if creds.AuthCode == "admin" {
+			return &bidirpc.Identity{Roles: []string{"admin"}}, nil
+		}
+		return &bidirpc.Identity{}, nil
+	}))
+	ran := make(chan string, 10)
+	for _, method := range []string{"Admin.Reset", "Status", "Internal"} {
+		server.RegisterHandler(method, func(ctx *bidirpc.Context) {
+			ran <- method
+			ctx.WriteResponse("ok")
+		})
+	}
+	server.Authorize("Admin.Reset", bidirpc.RequireRoles("admin"))
+	server.Authorize("Status", func(*bidirpc.Identity) bool { return true })
+	server.Handlers().SetDefaultPolicy(func(*bidirpc.Identity) bool { return false })
+	server.SetCallPolicy(func(c *bidirpc.Connection, method string) bool {
+		return method != "Wipe" || c.Identity().HasRole("admin")
+	})
+	addr, _ := startTestServer(t, server)
+	admin := dialTestClient(t, addr, "root", "admin")
+	user := dialTestClient(t, addr, "bob", "user")
+
+	forbidden := func(conn *bidirpc.Connection, method string) {
+		_, err := conn.Call(method, nil, time.Second)
+		var respErr *bidirpc.ResponseError
+		require.ErrorAs(t, err, &respErr, method)
+		require.Equal(t, bidirpc.ErrCodeForbidden, respErr.Code, method)
+	}
+	forbidden(user, "Admin.Reset")
+	forbidden(user, "Internal")
+	forbidden(admin, "Internal")
+	_, err := admin.Call("Admin.Reset", nil, time.Second)
+	require.NoError(t, err)
+	_, err = user.Call("Status", nil, time.Second)
+	require.NoError(t, err)
+	_, err = user.Call("Ping", nil, time.Second)
+	require.NoError(t, err)
+	require.ElementsMatch(t, []string{"Admin.Reset", "Status"}, []string{<-ran, <-ran})
+	require.Empty(t, ran)
+
+	// Topics follow the default policy unless they have their own.
+	published := make(chan string, 10)
+	for _, topic := range []string{"alerts", "public"} {
+		server.Subscribe(topic, func(ctx *bidirpc.Context, payload any) { published <- topic })
+	}
+	server.AuthorizeTopic("public", func(*bidirpc.Identity) bool { return true })
+	require.Eventually(t, func() bool { return user.PeerSubscribed("public") }, time.Second, 10*time.Millisecond)
+	require.NoError(t, user.Publish("alerts", "x"))
+	require.NoError(t, user.Publish("public", "x"))
+	require.Equal(t, "public", <-published)
+	select {
+	case topic := <-published:
+		t.Fatalf("unexpected publish on %s", topic)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	noop := func(*bidirpc.Context, any) {}
+	require.NoError(t, user.Subscribe("secret", noop))
+	require.NoError(t, user.Subscribe("public", noop))
+	require.Eventually(t, func() bool {
+		return slices.Equal(server.Subscribers("public"), []string{"bob"})
+	}, time.Second, 10*time.Millisecond)
+	require.Empty(t, server.Subscribers("secret"))
+
+	// Outgoing calls are checked before they leave the server.
+	_, err = server.Call("bob", "Wipe", nil, time.Second)
+	require.ErrorIs(t, err, bidirpc.ErrCallForbidden)
+	require.ErrorIs(t, server.Notify("bob", "Wipe", nil), bidirpc.ErrCallForbidden)
+	_, err = server.Call("root", "Wipe", nil, time.Second)
+	var respErr *bidirpc.ResponseError
+	require.ErrorAs(t, err, &respErr) // reached the client, which has no handler
+	require.Equal(t, bidirpc.ErrCodeMethodNotFound, respErr.Code)
+}
+
+func Test_TokenAuthentication(t *testing.T) {
+	jwt.TimePrecision = time.Millisecond // sub-second expiries keep the test fast
+	key := []byte("signing-key")
+	sign := func(sub string, ttl time.Duration) string {
+		token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+			"sub":    sub,
+			"tenant": "acme",
+			"roles":  []string{"admin"},
+			"exp":    jwt.NewNumericDate(time.Now().Add(ttl)),
+		}).SignedString(key)
+		require.NoError(t, err)
+		return token
+	}
+
+	server := bidirpc.NewServer(nil)
+	server.SetAuthenticator(bidirpc.JWTAuthenticator(func(*jwt.Token) (any, error) {
+		return key, nil
+	}, jwt.WithValidMethods([]string{"HS256"})))
+	server.RegisterHandler("WhoAmI", func(ctx *bidirpc.Context) {
+		id := ctx.Identity()
+		ctx.WriteResponse(fmt.Sprintf("%s@%s admin=%t", id.ClientID, id.Tenant, id.HasRole("admin")))
+	})
+	reasons := make(chan error, 10)
+	server.OnDisconnect(func(c *bidirpc.Connection, reason error) { reasons <- reason })
+	addr, _ := startTestServer(t, server)
+
+	dial := func(token string) *bidirpc.Connection {
+		return dialTestClientWith(t, addr, bidirpc.NegotiationMessage{
+			Type:    bidirpc.AuthRequestType,
+			Token:   token,
+			Version: bidirpc.ProtocolVersion,
+		})
+	}
+	conn := dial(sign("agent", 300*time.Millisecond))
+	require.WithinDuration(t, time.Now().Add(300*time.Millisecond), conn.ExpiresAt(), 100*time.Millisecond)
+	res, err := conn.Call("WhoAmI", nil, time.Second)
+	require.NoError(t, err)
+	require.Equal(t, "agent@acme admin=true", res)
+
+	// A session can be renewed in place, but not taken over by another client.
+	_, err = conn.Reauthenticate(context.Background(), sign("other", time.Hour))
+	var respErr *bidirpc.ResponseError
+	require.ErrorAs(t, err, &respErr)
+	require.Equal(t, bidirpc.ErrCodeUnauthorized, respErr.Code)
+	expiresAt, err := conn.Reauthenticate(context.Background(), sign("agent", time.Hour))
+	require.NoError(t, err)
+	require.Equal(t, expiresAt, conn.ExpiresAt())
+
+	// Sessions whose token lapses are closed by the server.
+	lapsing := dial(sign("lapsing", 300*time.Millisecond))
+	select {
+	case <-lapsing.Done():
+	case <-time.After(2 * time.Second):
+		t.Fatal("session outlived its token")
+	}
+	require.ErrorIs(t, <-reasons, bidirpc.ErrCredentialsExpired)
+	_, err = conn.Call("WhoAmI", nil, time.Second)
+	require.NoError(t, err, "renewed session")
+
+	// The AutoClient refreshes its token before it expires, without reconnecting.
+	var issued atomic.Int32
+	client := bidirpc.NewAutoClient(addr, "", "", false, nil, "", false, nil)
+	client.UseTokenAuth(func(ctx context.Context) (string, error) {
+		issued.Add(1)
+		return sign("auto", 500*time.Millisecond), nil
+	})
+	connects := make(chan struct{}, 10)
+	client.OnConnect(func(*bidirpc.Connection) { connects <- struct{}{} })
+	require.NoError(t, client.Start())
+	defer client.Stop()
+	time.Sleep(1500 * time.Millisecond)
+	require.True(t, client.IsConnected())
+	require.Len(t, connects, 1)
+	require.GreaterOrEqual(t, issued.Load(), int32(3))
+	res, err = client.Call("WhoAmI", nil, time.Second)
+	require.NoError(t, err)
+	require.Equal(t, "auto@acme admin=true", res)
+
+	// Expired tokens are refused during the handshake.
+	expired := bidirpc.NewAutoClient(addr, "", "", false, nil, "", false, nil)
+	expired.UseTokenAuth(func(ctx context.Context) (string, error) { return sign("late", -time.Minute), nil })
+	var authErr *bidirpc.AuthError
+	require.ErrorAs(t, expired.Start(), &authErr)
+	require.Equal(t, "token_expired", authErr.Code)
+
+	// A token without a subject cannot borrow the client ID the client claims.
+	anonymous := bidirpc.NewAutoClient(addr, "agent", "", false, nil, "", false, nil)
+	anonymous.UseTokenAuth(func(ctx context.Context) (string, error) { return sign("", time.Hour), nil })
+	require.ErrorAs(t, anonymous.Start(), &authErr)
+	require.Equal(t, "invalid_token", authErr.Code)
+	_, err = conn.Reauthenticate(context.Background(), sign("", time.Hour))
+	require.ErrorAs(t, err, &respErr)
+	require.Equal(t, bidirpc.ErrCodeUnauthorized, respErr.Code)
+
+	// So is a token that never expires.
+	forever, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{"sub": "agent"}).SignedString(key)
+	require.NoError(t, err)
+	immortal := bidirpc.NewAutoClient(addr, "", "", false, nil, "", false, nil)
+	immortal.UseTokenAuth(func(ctx context.Context) (string, error) { return forever, nil })
+	require.ErrorAs(t, immortal.Start(), &authErr)
+	require.Equal(t, "invalid_token", authErr.Code)
+
+	// Failed reauthentication is reported and backs off like a failed handshake.
+	failures := make(chan string, 10)
+	server.OnAuthFailed(func(clientID string, addr net.Addr, err error) { failures <- clientID })
+	server.SetLimits(bidirpc.Limits{AuthFailureBackoff: time.Minute})
+	_, err = conn.Reauthenticate(context.Background(), forever)
+	require.ErrorAs(t, err, &respErr)
+	require.Equal(t, "agent", <-failures)
+	_, err = conn.Reauthenticate(context.Background(), sign("agent", time.Hour))
+	require.ErrorAs(t, err, &respErr, "refused while backing off")
+	require.Equal(t, bidirpc.ErrCodeUnauthorized, respErr.Code)
+}
+
+func Test_AdmissionLimits(t *testing.T) {
+	newServer := func(limits bidirpc.Limits) string {
+		server := bidirpc.NewServer(func(id, code string) bool { return code == "s3cr3t" })
+		server.SetLimits(limits)
+		addr, _ := startTestServer(t, server)
+		return addr
+	}
+	// handshake reports whether the server answered an auth request.
+	handshake := func(addr, authCode string) bool {
+		raw, err := net.Dial("tcp", addr)
+		require.NoError(t, err)
+		defer raw.Close()
+		conn := bidirpc.NewConnection(raw)
+		if conn.SendNegotiation(bidirpc.NegotiationMessage{
+			Type:     bidirpc.AuthRequestType,
+			ClientID: "probe",
+			AuthCode: authCode,
+		}) != nil {
+			return false
+		}
+		var resp bidirpc.NegotiationMessage
+		return conn.ReceiveNegotiation(&resp) == nil
+	}
+
+	t.Run("handshake timeout", func(t *testing.T) {
+		addr := newServer(bidirpc.Limits{HandshakeTimeout: 200 * time.Millisecond})
+		raw, err := net.Dial("tcp", addr)
+		require.NoError(t, err)
+		defer raw.Close()
+		require.NoError(t, raw.SetReadDeadline(time.Now().Add(2*time.Second)))
+		_, err = raw.Read(make([]byte, 1))
+		require.ErrorIs(t, err, io.EOF, "idle connection closed by the server")
+	})
+
+	for name, limits := range map[string]bidirpc.Limits{
+		"max conns":        {MaxConns: 2},
+		"max conns per ip": {MaxConnsPerIP: 2},
+	} {
+		t.Run(name, func(t *testing.T) {
+			addr := newServer(limits)
+			first := dialTestClient(t, addr, "a", "s3cr3t")
+			dialTestClient(t, addr, "b", "s3cr3t")
+			require.False(t, handshake(addr, "s3cr3t"))
+
+			first.Close()
+			require.Eventually(t, func() bool { return handshake(addr, "s3cr3t") }, 2*time.Second, 20*time.Millisecond)
+		})
+	}
+
+	t.Run("handshake rate", func(t *testing.T) {
+		addr := newServer(bidirpc.Limits{HandshakeRate: 5, HandshakeBurst: 2})
+		require.True(t, handshake(addr, "s3cr3t"))
+		require.True(t, handshake(addr, "s3cr3t"))
+		require.False(t, handshake(addr, "s3cr3t"))
+		time.Sleep(250 * time.Millisecond)
+		require.True(t, handshake(addr, "s3cr3t"))
+	})
+
+	t.Run("auth failure backoff", func(t *testing.T) {
+		addr := newServer(bidirpc.Limits{AuthFailureBackoff: 200 * time.Millisecond})
+		require.True(t, handshake(addr, "wrong")) // answered with auth_fail
+		require.False(t, handshake(addr, "s3cr3t"))
+		time.Sleep(300 * time.Millisecond)
+		require.True(t, handshake(addr, "wrong"))
+		time.Sleep(200 * time.Millisecond)
+		require.False(t, handshake(addr, "s3cr3t"), "backoff doubled")
+		time.Sleep(300 * time.Millisecond)
+		require.True(t, handshake(addr, "s3cr3t"))
+	})
+}
+
+// startTestServer serves on a random local port and returns its address and
+// a channel receiving the result of ServeListener.
+func startTestServer(t *testing.T, server *bidirpc.Server) (string, <-chan error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err, "listen")
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- server.ServeListener(ln)
+	}()
+	t.Cleanup(func() { server.Close() })
+	return ln.Addr().String(), serveErr
+}
+
+// dialTestClient opens a single authenticated connection without reconnection.
+func dialTestClient(t *testing.T, addr, clientID, authCode string) *bidirpc.Connection {
+	return dialTestClientWith(t, addr, bidirpc.NegotiationMessage{
+		Type:         bidirpc.AuthRequestType,
+		ClientID:     clientID,
+		AuthCode:     authCode,
+		Version:      bidirpc.ProtocolVersion,
+		Capabilities: &bidirpc.Capabilities{Cancellation: true, Streaming: true},
+	})
+}
+
+// dialTestClientWith negotiates with neg and applies the capabilities
+// agreed by the server.
+func dialTestClientWith(t *testing.T, addr string, neg bidirpc.NegotiationMessage) *bidirpc.Connection {
+	raw, err := net.Dial("tcp", addr)
+	require.NoError(t, err, "dial")
+	conn := bidirpc.NewConnection(raw)
+	require.NoError(t, conn.SendNegotiation(neg))
+	var resp bidirpc.NegotiationMessage
+	require.NoError(t, conn.ReceiveNegotiation(&resp))
+	require.Equal(t, bidirpc.AuthOKType, resp.Type, "negotiation")
+	require.NoError(t, conn.ApplyNegotiation(resp))
+	conn.StartReadLoop()
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
 func generateSelfSignedCert(t *testing.T) tls.Certificate {
 	priv, _ := rsa.GenerateKey(rand.Reader, 2048)
 	template := x509.Certificate{
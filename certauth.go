@@ -0,0 +1,75 @@
+package bidirpc
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+)
+
+// CertName selects the part of a client certificate that names the client.
+type CertName int
+
+const (
+	CertCommonName CertName = iota // subject common name
+	CertDNSName                    // first DNS subject alternative name
+	CertURI                        // first URI SAN, e.g. spiffe://example.org/agent/42
+)
+
+// CertAuthenticator identifies clients by the certificate they presented
+// during a mutual TLS handshake. The server's tls.Config must verify client
+// certificates (tls.RequireAndVerifyClientCert or VerifyClientCertIfGiven);
+// unverified certificates are refused.
+type CertAuthenticator struct {
+	Name CertName
+
+	// RequireMatch refuses clients whose negotiated ClientID differs from
+	// the certificate name. Otherwise the certificate name replaces it.
+	RequireMatch bool
+}
+
+// Authenticate implements Authenticator.
+func (a CertAuthenticator) Authenticate(ctx context.Context, creds Credentials) (*Identity, error) {
+	if creds.TLS == nil || len(creds.TLS.VerifiedChains) == 0 {
+		return nil, &AuthError{Code: "certificate_required", Message: "verified client certificate required"}
+	}
+	name := certName(creds.TLS.PeerCertificates[0], a.Name)
+	if name == "" {
+		return nil, &AuthError{Code: "invalid_certificate", Message: "certificate does not name the client"}
+	}
+	if a.RequireMatch && name != creds.ClientID {
+		return nil, &AuthError{Code: "certificate_mismatch", Message: "client ID does not match the certificate"}
+	}
+	return &Identity{ClientID: name}, nil
+}
+
+func certName(cert *x509.Certificate, which CertName) string {
+	switch which {
+	case CertCommonName:
+		return cert.Subject.CommonName
+	case CertDNSName:
+		if len(cert.DNSNames) > 0 {
+			return cert.DNSNames[0]
+		}
+	case CertURI:
+		if len(cert.URIs) > 0 {
+			return cert.URIs[0].String()
+		}
+	}
+	return ""
+}
+
+// PeerCertificates returns the certificate chain presented by the peer,
+// leaf first, or nil if the connection does not use TLS.
+func (c *Connection) PeerCertificates() []*x509.Certificate {
+	tc, ok := c.Conn.(*tls.Conn)
+	if !ok {
+		return nil
+	}
+	return tc.ConnectionState().PeerCertificates
+}
+
+// PeerCertificates returns the certificate chain presented by the client
+// that sent the current request. See Connection.PeerCertificates.
+func (ctx *Context) PeerCertificates() []*x509.Certificate {
+	return ctx.conn.PeerCertificates()
+}
@@ -0,0 +1,115 @@
+package bidirpc
+
+import (
+	"encoding/json"
+	"io"
+	"reflect"
+	"sync"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// Names of the built-in codecs.
+const (
+	CodecJSON    = "json"
+	CodecMsgPack = "msgpack"
+	CodecCBOR    = "cbor"
+)
+
+// Encoder writes values to a stream.
+type Encoder interface {
+	Encode(v any) error
+}
+
+// Decoder reads values from a stream.
+type Decoder interface {
+	Decode(v any) error
+}
+
+// Codec serializes RPC messages on the wire. The codec is chosen during the
+// handshake; negotiation messages themselves are always JSON.
+type Codec interface {
+	Name() string
+	NewEncoder(w io.Writer) Encoder
+	NewDecoder(r io.Reader) Decoder
+}
+
+var (
+	codecsMu sync.RWMutex
+	codecs   = map[string]Codec{
+		CodecJSON:    jsonCodec{},
+		CodecMsgPack: msgpackCodec{},
+		CodecCBOR:    newCBORCodec(),
+	}
+)
+
+// RegisterCodec makes a codec available for negotiation under c.Name(),
+// replacing any codec registered with the same name.
+func RegisterCodec(c Codec) {
+	codecsMu.Lock()
+	defer codecsMu.Unlock()
+	codecs[c.Name()] = c
+}
+
+// GetCodec returns the codec registered under name, or nil.
+func GetCodec(name string) Codec {
+	codecsMu.RLock()
+	defer codecsMu.RUnlock()
+	return codecs[name]
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Name() string { return CodecJSON }
+
+func (jsonCodec) NewEncoder(w io.Writer) Encoder { return json.NewEncoder(w) }
+
+func (jsonCodec) NewDecoder(r io.Reader) Decoder { return json.NewDecoder(r) }
+
+// msgpackCodec uses json struct tags so RPCMessage and user types encode
+// the same field names as with JSON. Integers decode as int64 or uint64.
+type msgpackCodec struct{}
+
+func (msgpackCodec) Name() string { return CodecMsgPack }
+
+func (msgpackCodec) NewEncoder(w io.Writer) Encoder {
+	enc := msgpack.NewEncoder(w)
+	enc.SetCustomStructTag("json")
+	enc.SetOmitEmpty(true)
+	return enc
+}
+
+func (msgpackCodec) NewDecoder(r io.Reader) Decoder {
+	dec := msgpack.NewDecoder(r)
+	dec.SetCustomStructTag("json")
+	dec.UseLooseInterfaceDecoding(true)
+	return dec
+}
+
+// cborCodec decodes maps as map[string]any so params look the same as with
+// the other codecs.
+type cborCodec struct {
+	enc cbor.EncMode
+	dec cbor.DecMode
+}
+
+func newCBORCodec() cborCodec {
+	enc, err := cbor.EncOptions{}.EncMode()
+	if err != nil {
+		panic(err)
+	}
+	dec, err := cbor.DecOptions{
+		DefaultMapType: reflect.TypeOf(map[string]any(nil)),
+	}.DecMode()
+	if err != nil {
+		panic(err)
+	}
+	return cborCodec{enc: enc, dec: dec}
+}
+
+func (cborCodec) Name() string { return CodecCBOR }
+
+func (c cborCodec) NewEncoder(w io.Writer) Encoder { return c.enc.NewEncoder(w) }
+
+func (c cborCodec) NewDecoder(r io.Reader) Decoder { return c.dec.NewDecoder(r) }
@@ -1,12 +1,16 @@
 package bidirpc
 
 import (
+	"bufio"
 	"compress/gzip"
-	"encoding/json"
+	"context"
+	"errors"
 	"fmt"
 	"log"
 	"net"
+	"runtime/debug"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/google/uuid"
@@ -14,26 +18,80 @@ import (
 
 type Connection struct {
 	Conn           net.Conn
-	Enc            *json.Encoder
-	Dec            *json.Decoder
+	Enc            Encoder
+	Dec            Decoder
 	sendMu         sync.Mutex // protects Send()
 	initMu         sync.Mutex // protects gzip.Reader setup and decoder init
+	r              *bufio.Reader
+	codec          Codec
+	framed         bool         // length-prefixed frames, see framing.go
+	maxFrameSize   int          // largest frame accepted from the peer
+	peerFrameSize  int          // largest frame the peer accepts
+	caps           Capabilities // agreed during the handshake
+	version        int
 	useCompression bool
 	gzWriter       *gzip.Writer
 	gzReader       *gzip.Reader
 	pending        map[string]chan RPCMessage
 	pendingMu      sync.Mutex
+	inflight       map[string]context.CancelFunc // running handlers by request ID
+	inflightMu     sync.Mutex
+	streams        map[string]streamEntry // open streamed responses by request ID
+	streamsMu      sync.Mutex
 	handlers       *HandlerRegistry
+	topics         *topicRegistry      // local topic handlers
+	peerTopics     map[string]struct{} // topics the peer subscribed to
+	topicsMu       sync.Mutex          // protects peerTopics
+	interceptors   *interceptorChain
+	onPanic        PanicHandler
+	callPolicy     CallPolicy // checked before outgoing calls
 	clientID       string
+	sessionID      string
+	identity       atomic.Pointer[Identity]              // set by the server after authentication
+	reauth         func(token string) (*Identity, error) // checks tokens from reauth messages
+	expiresAt      time.Time                             // when the credentials lapse
+	expiryTimer    *time.Timer                           // closes the connection at expiresAt
+	expiryMu       sync.Mutex                            // protects expiresAt and expiryTimer
+	ctx            context.Context                       // cancelled when the connection is closed
+	cancel         context.CancelFunc
+	done           chan struct{}
+	readDone       chan struct{}   // closed once the read loop and onDisconnect are done
+	onDisconnect   func(err error) // set by the owner before StartReadLoop
+	closeErr       error           // why the connection was closed
+	closeOnce      sync.Once
+	activeMu       sync.Mutex // protects draining and active.Add
+	active         sync.WaitGroup
+	draining       bool
 }
 
+// closeFlushTimeout bounds how long Close waits to flush buffered output.
+const closeFlushTimeout = 2 * time.Second
+
+// ErrConnectionClosed is returned by calls, streams and Send once the
+// connection is closed. Connection.Err wraps it with the cause.
+var ErrConnectionClosed = errors.New("connection closed")
+
 func NewConnection(conn net.Conn) *Connection {
+	ctx, cancel := context.WithCancel(context.Background())
+	r := bufio.NewReader(conn)
+	codec := GetCodec(CodecJSON)
 	return &Connection{
-		Conn:     conn,
-		Enc:      json.NewEncoder(conn),
-		Dec:      json.NewDecoder(conn),
-		pending:  make(map[string]chan RPCMessage),
-		handlers: NewHandlerRegistry(),
+		Conn:         conn,
+		Enc:          codec.NewEncoder(conn),
+		Dec:          codec.NewDecoder(r),
+		r:            r,
+		codec:        codec,
+		pending:      make(map[string]chan RPCMessage),
+		inflight:     make(map[string]context.CancelFunc),
+		streams:      make(map[string]streamEntry),
+		handlers:     NewHandlerRegistry(),
+		topics:       newTopicRegistry(),
+		peerTopics:   make(map[string]struct{}),
+		interceptors: &interceptorChain{},
+		ctx:          ctx,
+		cancel:       cancel,
+		done:         make(chan struct{}),
+		readDone:     make(chan struct{}),
 	}
 }
 
@@ -47,7 +105,8 @@ func (r *ResponseError) Error() string {
 }
 
 // EnableCompression sets up gzip writer and marks the connection as compressed.
-// Reader is initialized lazily in readLoop.
+// Reader is initialized lazily in readLoop. In framed mode each frame is
+// compressed on its own instead.
 func (c *Connection) EnableCompression() error {
 	c.initMu.Lock()
 	defer c.initMu.Unlock()
@@ -55,50 +114,170 @@ func (c *Connection) EnableCompression() error {
 	if c.useCompression {
 		return nil
 	}
+	if c.framed {
+		c.sendMu.Lock()
+		c.useCompression = true
+		c.sendMu.Unlock()
+		return nil
+	}
 
 	c.gzWriter = gzip.NewWriter(c.Conn)
-	c.Enc = json.NewEncoder(c.gzWriter)
+	c.Enc = c.codec.NewEncoder(c.gzWriter)
 	c.useCompression = true
 	return nil
 }
 
+// SetCodec switches the codec used for RPC messages. Both peers must agree
+// on it during the handshake; call it before StartReadLoop.
+func (c *Connection) SetCodec(codec Codec) {
+	c.initMu.Lock()
+	defer c.initMu.Unlock()
+	c.sendMu.Lock()
+	defer c.sendMu.Unlock()
+
+	c.codec = codec
+	if c.gzWriter != nil {
+		c.Enc = codec.NewEncoder(c.gzWriter)
+	} else {
+		c.Enc = codec.NewEncoder(c.Conn)
+	}
+	if c.gzReader != nil {
+		c.Dec = codec.NewDecoder(c.gzReader)
+	} else {
+		c.Dec = codec.NewDecoder(c.r)
+	}
+}
+
+// Codec returns the codec used for RPC messages.
+func (c *Connection) Codec() Codec {
+	c.initMu.Lock()
+	defer c.initMu.Unlock()
+	return c.codec
+}
+
 // StartReadLoop begins the message decoding loop in a goroutine.
 func (c *Connection) StartReadLoop() {
 	go c.readLoop()
 }
 
 func (c *Connection) readLoop() {
-	defer func() {
-		log.Println("[conn] readLoop terminated")
-		c.connClosed()
-	}()
+	err := c.readMessages()
+	log.Println("[conn] readLoop terminated:", err)
+	c.connClosed(err)
+}
+
+// readMessages dispatches incoming messages until reading fails.
+func (c *Connection) readMessages() error {
+	c.initMu.Lock()
+	framed := c.framed
+	c.initMu.Unlock()
+	if framed {
+		for {
+			msg, err := c.readFrame()
+			if err != nil {
+				return fmt.Errorf("frame read error: %w", err)
+			}
+			c.handleMessage(msg)
+		}
+	}
 
 	for {
 		c.initMu.Lock()
 		if c.useCompression && c.gzReader == nil {
-			gr, err := gzip.NewReader(c.Conn)
+			gr, err := gzip.NewReader(c.r)
 			if err != nil {
 				c.initMu.Unlock()
-				log.Println("[conn] gzip.NewReader failed:", err)
-				return
+				return fmt.Errorf("gzip.NewReader failed: %w", err)
 			}
 			c.gzReader = gr
-			c.Dec = json.NewDecoder(gr)
+			c.Dec = c.codec.NewDecoder(gr)
 		}
 		dec := c.Dec
 		c.initMu.Unlock()
 
 		var msg RPCMessage
 		if err := dec.Decode(&msg); err != nil {
-			log.Println("[conn] decode error:", err)
-			return
+			return fmt.Errorf("decode error: %w", err)
 		}
 		c.handleMessage(msg)
 	}
 }
 
-func (c *Connection) connClosed() {
-	// Placeholder for optional client/server cleanup callback
+// connClosed runs when the read loop exits. The connection is unusable at
+// that point, so it is closed to release handlers and waiters before the
+// owner is told. If the connection was closed locally, that is the reason
+// reported rather than the resulting read error.
+func (c *Connection) connClosed(err error) {
+	c.closeWithReason(err)
+	if c.onDisconnect != nil {
+		c.onDisconnect(c.closeErr)
+	}
+	close(c.readDone)
+}
+
+// Close cancels running handlers, fails pending calls and closes the
+// underlying transport. Buffered compressed output is flushed first so the
+// peer never sees a truncated frame.
+func (c *Connection) Close() error {
+	return c.closeWithReason(ErrConnectionClosed)
+}
+
+// closeWithReason closes the connection, recording reason as the cause if
+// it was still open.
+func (c *Connection) closeWithReason(reason error) error {
+	var err error
+	c.closeOnce.Do(func() {
+		if !errors.Is(reason, ErrConnectionClosed) {
+			reason = fmt.Errorf("%w: %w", ErrConnectionClosed, reason)
+		}
+		c.closeErr = reason
+		close(c.done)
+		c.cancel()
+		c.stopExpiry()
+
+		// A Send blocked on a stalled peer must not keep us from closing.
+		_ = c.Conn.SetWriteDeadline(time.Now().Add(closeFlushTimeout))
+		c.sendMu.Lock()
+		if c.useCompression && c.gzWriter != nil {
+			_ = c.gzWriter.Close()
+		}
+		c.sendMu.Unlock()
+
+		err = c.Conn.Close()
+	})
+	return err
+}
+
+// Done returns a channel that is closed when the connection is closed.
+func (c *Connection) Done() <-chan struct{} {
+	return c.done
+}
+
+// Err returns nil while the connection is open. Once it is closed, it
+// returns an error wrapping ErrConnectionClosed and the cause, such as
+// io.EOF when the peer hung up or ErrServerClosed on shutdown.
+func (c *Connection) Err() error {
+	select {
+	case <-c.done:
+		return c.closeErr
+	default:
+		return nil
+	}
+}
+
+// drain stops dispatching new requests and returns a channel that is closed
+// once every in-flight handler has returned.
+func (c *Connection) drain() <-chan struct{} {
+	c.activeMu.Lock()
+	c.draining = true
+	c.activeMu.Unlock()
+
+	ch := make(chan struct{})
+	go func() {
+		c.active.Wait()
+		close(ch)
+	}()
+	return ch
 }
 
 // Send serializes and transmits a message. Safe for concurrent use.
@@ -106,6 +285,13 @@ func (c *Connection) Send(msg RPCMessage) error {
 	c.sendMu.Lock()
 	defer c.sendMu.Unlock()
 
+	if err := c.Err(); err != nil {
+		return err
+	}
+
+	if c.framed {
+		return c.sendFrame(msg)
+	}
 	if err := c.Enc.Encode(msg); err != nil {
 		return err
 	}
@@ -125,19 +311,50 @@ func (c *Connection) handleMessage(msg RPCMessage) {
 			delete(c.pending, msg.ID)
 		}
 		c.pendingMu.Unlock()
+		if !ok {
+			c.routeStream(msg)
+		}
+
+	case StreamType:
+		c.routeStream(msg)
 
 	case RequestType:
-		ctx := &Context{
-			conn:     c,
-			clientID: c.clientID,
-			id:       msg.ID,
-			params:   msg.Params,
+		ctx := c.newContext(msg)
+		fn := c.handlers.Get(msg.Method)
+		if fn == nil {
+			ctx.WriteError(ErrCodeMethodNotFound, "method not found")
+			return
 		}
+		c.startHandler(ctx, msg.Method, fn)
+
+	case NotificationType:
+		ctx := c.newContext(msg)
+		ctx.notification = true
 		fn := c.handlers.Get(msg.Method)
-		if fn != nil {
-			go fn(ctx)
-		} else {
-			ctx.WriteError(404, "method not found")
+		if fn == nil {
+			log.Println("[conn] notification for unknown method:", msg.Method)
+			return
+		}
+		c.startHandler(ctx, msg.Method, fn)
+
+	case SubscribeType, UnsubscribeType, PublishType:
+		c.handleTopicMessage(msg)
+
+	case ReauthType:
+		go c.handleReauth(msg)
+
+	case StreamOpenType:
+		c.openStream(msg)
+
+	case StreamCloseType:
+		c.routeStream(msg)
+
+	case CancelType:
+		c.inflightMu.Lock()
+		cancel, ok := c.inflight[msg.ID]
+		c.inflightMu.Unlock()
+		if ok {
+			cancel()
 		}
 
 	default:
@@ -145,26 +362,149 @@ func (c *Connection) handleMessage(msg RPCMessage) {
 	}
 }
 
+func (c *Connection) newContext(msg RPCMessage) *Context {
+	return &Context{
+		conn:     c,
+		clientID: c.clientID,
+		id:       msg.ID,
+		params:   msg.Params,
+	}
+}
+
+// startHandler runs fn in its own goroutine with a context that is cancelled
+// when the caller sends a cancel message. It reports false if the connection
+// is draining and the request was rejected.
+func (c *Connection) startHandler(ctx *Context, method string, fn HandlerFunc) bool {
+	c.activeMu.Lock()
+	if c.draining {
+		c.activeMu.Unlock()
+		ctx.WriteError(ErrCodeUnavailable, "server shutting down")
+		return false
+	}
+	c.active.Add(1)
+	c.activeMu.Unlock()
+
+	reqCtx, cancel := context.WithCancel(c.ctx)
+	ctx.ctx = reqCtx
+	// Notifications have no ID, so the caller cannot cancel them.
+	cancellable := !ctx.notification
+	if cancellable {
+		c.inflightMu.Lock()
+		c.inflight[ctx.id] = cancel
+		c.inflightMu.Unlock()
+	}
+
+	go func() {
+		defer c.active.Done()
+		defer func() {
+			if cancellable {
+				c.inflightMu.Lock()
+				delete(c.inflight, ctx.id)
+				c.inflightMu.Unlock()
+			}
+			cancel()
+		}()
+		c.dispatch(ctx, method, fn)
+		ctx.finish()
+	}()
+	return true
+}
+
+// dispatch runs fn, turning a panic into an ErrCodeHandlerPanic response
+// unless the handler already sent its response.
+func (c *Connection) dispatch(ctx *Context, method string, fn HandlerFunc) {
+	defer func() {
+		r := recover()
+		if r == nil {
+			return
+		}
+		stack := debug.Stack()
+		log.Printf("[conn] handler %s panicked: %v", method, r)
+		switch {
+		case ctx.replied.Load():
+			log.Printf("[conn] handler %s had already replied, no error sent", method)
+		case ctx.stream != nil:
+			ctx.stream.finish(&ResponseError{Code: ErrCodeHandlerPanic, Message: "handler panicked"})
+		default:
+			ctx.WriteError(ErrCodeHandlerPanic, "handler panicked")
+		}
+		if c.onPanic != nil {
+			c.onPanic(ctx, r, stack)
+		}
+	}()
+	fn(ctx)
+}
+
+// ErrNotificationsUnsupported is returned when the peer speaks protocol
+// version 1, which has no one-way messages.
+var ErrNotificationsUnsupported = errors.New("peer does not support notifications")
+
+// Notify sends a one-way notification. The peer runs the handler for method
+// but sends nothing back, so Notify returns once the message is written.
+func (c *Connection) Notify(method string, params map[string]any) error {
+	if c.ProtocolVersion() < 2 {
+		return ErrNotificationsUnsupported
+	}
+	if err := c.checkCall(method); err != nil {
+		return err
+	}
+	return c.Send(RPCMessage{
+		Type:   NotificationType,
+		Method: method,
+		Params: params,
+	})
+}
+
 // Call sends a request and waits for a response.
 func (c *Connection) Call(method string, params map[string]any, timeout time.Duration) (any, error) {
-	id := uuid.NewString()
-	ch := make(chan RPCMessage, 1)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
 
-	c.pendingMu.Lock()
-	c.pending[id] = ch
-	c.pendingMu.Unlock()
+	res, err := c.CallContext(ctx, method, params)
+	if errors.Is(err, context.DeadlineExceeded) {
+		return nil, fmt.Errorf("timeout after %s", timeout)
+	}
+	return res, err
+}
 
-	req := RPCMessage{
+// CallContext sends a request and waits for a response until ctx is done.
+func (c *Connection) CallContext(ctx context.Context, method string, params map[string]any) (any, error) {
+	return c.interceptors.wrap(c.roundTrip)(ctx, method, params)
+}
+
+// UseInterceptor appends interceptors run around every outgoing call on this
+// connection only. On connections created by a Server or AutoClient, they
+// run inside the interceptors of the owner.
+func (c *Connection) UseInterceptor(interceptors ...Interceptor) {
+	c.interceptors.use(interceptors...)
+}
+
+type callIDKey struct{}
+
+// roundTrip sends a request and waits for its response. It is the innermost
+// Invoker of the interceptor chain.
+func (c *Connection) roundTrip(ctx context.Context, method string, params map[string]any) (any, error) {
+	if err := c.checkCall(method); err != nil {
+		return nil, err
+	}
+	id, _ := ctx.Value(callIDKey{}).(string)
+	if id == "" {
+		id = uuid.NewString()
+	}
+	return c.exchange(ctx, RPCMessage{
 		Type:   RequestType,
 		ID:     id,
 		Method: method,
 		Params: params,
-	}
+	})
+}
+
+// exchange sends req and waits for the response with the same ID.
+func (c *Connection) exchange(ctx context.Context, req RPCMessage) (any, error) {
+	ch := c.addPending(req.ID)
+	defer c.removePending(req.ID)
 
 	if err := c.Send(req); err != nil {
-		c.pendingMu.Lock()
-		delete(c.pending, id)
-		c.pendingMu.Unlock()
 		return nil, err
 	}
 
@@ -177,11 +517,11 @@ func (c *Connection) Call(method string, params map[string]any, timeout time.Dur
 			}
 		}
 		return msg.Result, nil
-	case <-time.After(timeout):
-		c.pendingMu.Lock()
-		delete(c.pending, id)
-		c.pendingMu.Unlock()
-		return nil, fmt.Errorf("timeout after %s", timeout)
+	case <-c.done:
+		return nil, c.Err()
+	case <-ctx.Done():
+		c.sendCancel(req.ID)
+		return nil, ctx.Err()
 	}
 }
 
@@ -194,71 +534,68 @@ func (c *Connection) CallWithResult(method string, params map[string]any, timeou
 	return decodeInto(resultPtr, res)
 }
 
-// CallAsync sends a request and calls the callback when the response arrives.
-func (c *Connection) CallAsync(method string, params map[string]any, timeout time.Duration, callback func(any, error)) *CallContext {
-	id := uuid.NewString()
-	ch := make(chan RPCMessage, 1)
-
-	c.pendingMu.Lock()
-	c.pending[id] = ch
-	c.pendingMu.Unlock()
-
-	req := RPCMessage{
-		Type:   RequestType,
-		ID:     id,
-		Method: method,
-		Params: params,
+// CallWithResultContext sends a request and decodes the response into resultPtr.
+func (c *Connection) CallWithResultContext(ctx context.Context, method string, params map[string]any, resultPtr any) error {
+	res, err := c.CallContext(ctx, method, params)
+	if err != nil {
+		return err
 	}
+	return decodeInto(resultPtr, res)
+}
 
-	if err := c.Send(req); err != nil {
-		c.pendingMu.Lock()
-		delete(c.pending, id)
-		c.pendingMu.Unlock()
+// CallAsync sends a request and calls the callback when the response arrives.
+func (c *Connection) CallAsync(method string, params map[string]any, timeout time.Duration, callback func(any, error)) *CallContext {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	return c.CallAsyncContext(ctx, method, params, func(res any, err error) {
+		cancel()
+		if errors.Is(err, context.DeadlineExceeded) {
+			err = fmt.Errorf("timeout after %s", timeout)
+		}
 		if callback != nil {
-			go callback(nil, err)
+			callback(res, err)
 		}
-		return nil
-	}
+	})
+}
 
-	ctx := &CallContext{
-		ID:       id,
+// CallAsyncContext sends a request and calls the callback when the response
+// arrives, ctx is done or the returned CallContext is cancelled.
+func (c *Connection) CallAsyncContext(ctx context.Context, method string, params map[string]any, callback func(any, error)) *CallContext {
+	ctx, cancel := context.WithCancel(ctx)
+	cc := &CallContext{
+		ID:       uuid.NewString(),
 		cancelCh: make(chan struct{}),
+		cancel:   cancel,
 		conn:     c,
 	}
+	ctx = context.WithValue(ctx, callIDKey{}, cc.ID)
 
 	go func() {
-		defer func() {
-			c.pendingMu.Lock()
-			delete(c.pending, id)
-			c.pendingMu.Unlock()
-		}()
-
-		select {
-		case msg := <-ch:
-			if callback != nil {
-				if msg.Error != nil {
-					callback(nil, fmt.Errorf("error code %d: %s", msg.ErrorCode, *msg.Error))
-				} else {
-					callback(msg.Result, nil)
-				}
-			}
-		case <-time.After(timeout):
-			if callback != nil {
-				callback(nil, fmt.Errorf("timeout after %s", timeout))
-			}
-		case <-ctx.cancelCh:
-			if callback != nil {
-				callback(nil, fmt.Errorf("call cancelled"))
-			}
+		defer cancel()
+		res, err := c.CallContext(ctx, method, params)
+		if errors.Is(err, context.Canceled) && cc.cancelled() {
+			err = fmt.Errorf("call cancelled")
+		}
+		if callback != nil {
+			callback(res, err)
 		}
 	}()
 
-	return ctx
+	return cc
 }
 
 // CallAsyncWithResult sends a request and decodes result into resultPtr.
 func (c *Connection) CallAsyncWithResult(method string, params map[string]any, timeout time.Duration, resultPtr any, callback func(error)) *CallContext {
-	return c.CallAsync(method, params, timeout, func(res any, err error) {
+	return c.CallAsync(method, params, timeout, resultCallback(resultPtr, callback))
+}
+
+// CallAsyncWithResultContext sends a request and decodes result into resultPtr.
+func (c *Connection) CallAsyncWithResultContext(ctx context.Context, method string, params map[string]any, resultPtr any, callback func(error)) *CallContext {
+	return c.CallAsyncContext(ctx, method, params, resultCallback(resultPtr, callback))
+}
+
+// resultCallback adapts a decode-into-resultPtr callback to a raw result callback.
+func resultCallback(resultPtr any, callback func(error)) func(any, error) {
+	return func(res any, err error) {
 		if err != nil {
 			if callback != nil {
 				callback(err)
@@ -268,19 +605,57 @@ func (c *Connection) CallAsyncWithResult(method string, params map[string]any, t
 		if callback != nil {
 			callback(decodeInto(resultPtr, res))
 		}
-	})
+	}
+}
+
+// sendCancel tells the peer to cancel the handler running for request id.
+// Peers that did not negotiate cancellation are left alone.
+func (c *Connection) sendCancel(id string) {
+	if !c.Capabilities().Cancellation {
+		return
+	}
+	if err := c.Send(RPCMessage{Type: CancelType, ID: id}); err != nil {
+		log.Println("[conn] failed to send cancel:", err)
+	}
+}
+
+// addPending registers a response channel for the request id.
+func (c *Connection) addPending(id string) chan RPCMessage {
+	ch := make(chan RPCMessage, 1)
+	c.pendingMu.Lock()
+	c.pending[id] = ch
+	c.pendingMu.Unlock()
+	return ch
+}
+
+func (c *Connection) removePending(id string) {
+	c.pendingMu.Lock()
+	delete(c.pending, id)
+	c.pendingMu.Unlock()
 }
 
 type CallContext struct {
 	ID       string
 	cancelCh chan struct{}
+	cancel   context.CancelFunc
+	once     sync.Once
 	conn     *Connection
 }
 
+// Cancel stops waiting for the response and asks the peer to cancel the
+// running handler.
 func (cc *CallContext) Cancel() {
+	cc.once.Do(func() {
+		close(cc.cancelCh)
+		cc.cancel()
+	})
+}
+
+func (cc *CallContext) cancelled() bool {
 	select {
 	case <-cc.cancelCh:
+		return true
 	default:
-		close(cc.cancelCh)
+		return false
 	}
 }
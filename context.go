@@ -1,10 +1,23 @@
 package bidirpc
 
+import (
+	"context"
+	"errors"
+	"log"
+	"sync/atomic"
+)
+
 type Context struct {
 	conn     *Connection
+	ctx      context.Context
 	clientID string
 	id       string
 	params   map[string]any
+	stream   *Stream // set for stream handlers
+
+	notification bool        // replies are discarded
+	replied      atomic.Bool // the final response was sent
+	streamed     atomic.Bool // items were sent with Send
 }
 
 // ClientID returns the ID of the client that sent the current request.
@@ -12,6 +25,28 @@ func (ctx *Context) ClientID() string {
 	return ctx.clientID
 }
 
+// IsNotification reports whether the request is a notification. Responses
+// written for a notification are discarded.
+func (ctx *Context) IsNotification() bool {
+	return ctx.notification
+}
+
+// Context returns a context.Context that is cancelled when the caller
+// cancels the request or gives up waiting for it, or when the connection
+// carrying the request is closed.
+func (ctx *Context) Context() context.Context {
+	if ctx.ctx == nil {
+		return ctx.conn.ctx
+	}
+	return ctx.ctx
+}
+
+// Done returns a channel that is closed once the caller no longer needs the
+// response. Long-running handlers should stop when it fires.
+func (ctx *Context) Done() <-chan struct{} {
+	return ctx.Context().Done()
+}
+
 // GetParamString retrieves a string parameter with default value.
 func (ctx *Context) GetParamString(name, def string) string {
 	val, ok := ctx.params[name]
@@ -31,11 +66,18 @@ func (ctx *Context) GetParamInt(name string, def int) int {
 	if !ok {
 		return def
 	}
-	f, ok := val.(float64) // JSON numbers are float64
-	if !ok {
+	switch n := val.(type) {
+	case float64: // JSON numbers are float64
+		return int(n)
+	case int64:
+		return int(n)
+	case uint64:
+		return int(n)
+	case int:
+		return n
+	default:
 		return def
 	}
-	return int(f)
 }
 
 // WriteResponse sends a successful response back to the caller.
@@ -45,7 +87,7 @@ func (ctx *Context) WriteResponse(result any) {
 		ID:     ctx.id,
 		Result: result,
 	}
-	_ = ctx.conn.Send(msg)
+	_ = ctx.reply(msg)
 }
 
 // WriteError sends an error response back to the caller.
@@ -56,5 +98,68 @@ func (ctx *Context) WriteError(code int, message string) {
 		Error:     &message,
 		ErrorCode: code,
 	}
-	_ = ctx.conn.Send(msg)
+	_ = ctx.reply(msg)
+}
+
+// writeErr sends err as an error response, keeping the code of a *ResponseError.
+func (ctx *Context) writeErr(err error) {
+	_ = ctx.reply(errorResponse(ctx.id, err))
+}
+
+// finish ends a streamed response whose handler returned without Close, and
+// a stream whose handler never ran, e.g. because a middleware returned
+// early, so the caller never waits forever. Other handlers may still reply
+// later from another goroutine.
+func (ctx *Context) finish() {
+	if ctx.replied.Load() {
+		return
+	}
+	if ctx.stream != nil {
+		ctx.stream.finish(nil)
+		return
+	}
+	if !ctx.streamed.Load() {
+		return
+	}
+	_ = ctx.reply(RPCMessage{Type: ResponseType, ID: ctx.id})
+}
+
+// reply sends msg to the caller, unless the request was a notification. A
+// response too large for the peer is replaced by an ErrCodeTooLarge error,
+// so the caller does not wait for it.
+func (ctx *Context) reply(msg RPCMessage) error {
+	if ctx.notification {
+		return nil
+	}
+	if msg.Type == ResponseType {
+		ctx.replied.Store(true)
+	}
+	err := ctx.conn.Send(msg)
+	if msg.Type == ResponseType && errors.Is(err, ErrFrameTooLarge) {
+		log.Printf("[conn] response to %s dropped: %v", ctx.id, err)
+		text := "response too large"
+		_ = ctx.conn.Send(RPCMessage{
+			Type:      ResponseType,
+			ID:        ctx.id,
+			Error:     &text,
+			ErrorCode: ErrCodeTooLarge,
+		})
+	}
+	return err
+}
+
+// errorResponse builds the response for err. A *ResponseError keeps its code;
+// other errors are sent as ErrCodeInternal.
+func errorResponse(id string, err error) RPCMessage {
+	code, text := ErrCodeInternal, err.Error()
+	var respErr *ResponseError
+	if errors.As(err, &respErr) {
+		code, text = respErr.Code, respErr.Message
+	}
+	return RPCMessage{
+		Type:      ResponseType,
+		ID:        id,
+		Error:     &text,
+		ErrorCode: code,
+	}
 }
@@ -0,0 +1,216 @@
+package bidirpc
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+)
+
+// Framed mode wraps every message in a frame:
+//
+//	uint32 length   number of bytes after this field
+//	uint8  flags    frameCompressed
+//	uint8  type     message type code, see frameTypes
+//	uint16 idLen
+//	[idLen]byte id
+//	payload         codec-encoded RPCMessage, gzipped if frameCompressed
+//
+// The header lets a peer skip frames it cannot decode and still answer the
+// request they belonged to. A frame longer than the receiver's maximum size
+// closes the connection without being read.
+
+// DefaultMaxFrameSize is the largest frame accepted unless configured otherwise.
+const DefaultMaxFrameSize = 16 << 20
+
+const (
+	frameCompressed byte = 1 << 0
+
+	frameHeaderSize = 4  // flags, type and idLen
+	maxFrameIDLen   = 64 // generous for UUIDs
+
+	// Payloads smaller than this are not worth compressing.
+	frameCompressThreshold = 256
+)
+
+// frameTypes maps message types to their header code. Types without a code
+// are sent as 0 and identified from the payload only.
+var frameTypes = map[MessageType]byte{
+	RequestType:  1,
+	ResponseType: 2,
+	CancelType:   3,
+	StreamType:   4,
+
+	StreamOpenType:  5,
+	StreamCloseType: 6,
+
+	NotificationType: 7,
+
+	SubscribeType:   8,
+	UnsubscribeType: 9,
+	PublishType:     10,
+
+	ReauthType: 11,
+}
+
+// ErrFrameTooLarge is returned by Send when a message exceeds the frame size
+// accepted by the peer, and ends a connection whose peer sent such a frame.
+var ErrFrameTooLarge = errors.New("frame too large")
+
+type frameHeader struct {
+	length int // bytes after the length field
+	flags  byte
+	typ    byte
+	id     string
+}
+
+// EnableFraming switches the connection to length-prefixed frames. A frame
+// from the peer larger than maxFrameSize closes the connection; 0 means
+// DefaultMaxFrameSize. Outgoing frames are held to the same limit, which
+// ApplyNegotiation sets to the smaller of the two peers' limits. Both peers
+// must agree on framing during the handshake; call it before
+// EnableCompression and StartReadLoop.
+func (c *Connection) EnableFraming(maxFrameSize int) {
+	if maxFrameSize <= 0 {
+		maxFrameSize = DefaultMaxFrameSize
+	}
+	c.initMu.Lock()
+	defer c.initMu.Unlock()
+	c.sendMu.Lock()
+	defer c.sendMu.Unlock()
+	c.framed = true
+	c.maxFrameSize = maxFrameSize
+	c.peerFrameSize = maxFrameSize
+}
+
+// sendFrame encodes msg into a single frame. Caller must hold sendMu.
+func (c *Connection) sendFrame(msg RPCMessage) error {
+	var payload bytes.Buffer
+	if err := c.codec.NewEncoder(&payload).Encode(msg); err != nil {
+		return err
+	}
+
+	var flags byte
+	if c.useCompression && payload.Len() >= frameCompressThreshold {
+		var zipped bytes.Buffer
+		zw := gzip.NewWriter(&zipped)
+		if _, err := zw.Write(payload.Bytes()); err != nil {
+			return err
+		}
+		if err := zw.Close(); err != nil {
+			return err
+		}
+		payload = zipped
+		flags |= frameCompressed
+	}
+
+	if len(msg.ID) > maxFrameIDLen {
+		return fmt.Errorf("message id too long: %d bytes", len(msg.ID))
+	}
+	length := frameHeaderSize + len(msg.ID) + payload.Len()
+	if length > c.peerFrameSize {
+		return fmt.Errorf("%w: %d bytes (peer accepts %d)", ErrFrameTooLarge, length, c.peerFrameSize)
+	}
+
+	buf := make([]byte, 0, 4+length)
+	buf = binary.BigEndian.AppendUint32(buf, uint32(length))
+	buf = append(buf, flags, frameTypes[msg.Type])
+	buf = binary.BigEndian.AppendUint16(buf, uint16(len(msg.ID)))
+	buf = append(buf, msg.ID...)
+	buf = append(buf, payload.Bytes()...)
+	_, err := c.Conn.Write(buf)
+	return err
+}
+
+// readFrame returns the next decodable message. Frames that cannot be
+// decoded are skipped and reported to the peer when possible. Errors
+// returned, including frames over the size limit, are fatal for the stream.
+func (c *Connection) readFrame() (RPCMessage, error) {
+	for {
+		hdr, err := c.readFrameHeader()
+		if err != nil {
+			return RPCMessage{}, err
+		}
+		payloadLen := hdr.length - frameHeaderSize - len(hdr.id)
+
+		if hdr.length > c.maxFrameSize {
+			c.rejectFrame(hdr, ErrCodeTooLarge, "message too large")
+			return RPCMessage{}, fmt.Errorf("%w: %d bytes (max %d)", ErrFrameTooLarge, hdr.length, c.maxFrameSize)
+		}
+
+		payload := make([]byte, payloadLen)
+		if _, err := io.ReadFull(c.r, payload); err != nil {
+			return RPCMessage{}, err
+		}
+
+		msg, err := c.decodeFrame(hdr, payload)
+		if err != nil {
+			log.Println("[conn] skipped malformed frame:", err)
+			c.rejectFrame(hdr, ErrCodeBadRequest, "malformed message")
+			continue
+		}
+		return msg, nil
+	}
+}
+
+func (c *Connection) readFrameHeader() (frameHeader, error) {
+	var fixed [4 + frameHeaderSize]byte
+	if _, err := io.ReadFull(c.r, fixed[:]); err != nil {
+		return frameHeader{}, err
+	}
+	hdr := frameHeader{
+		length: int(binary.BigEndian.Uint32(fixed[0:4])),
+		flags:  fixed[4],
+		typ:    fixed[5],
+	}
+	idLen := int(binary.BigEndian.Uint16(fixed[6:8]))
+	if idLen > maxFrameIDLen || hdr.length < frameHeaderSize+idLen {
+		return frameHeader{}, fmt.Errorf("corrupt frame header")
+	}
+	id := make([]byte, idLen)
+	if _, err := io.ReadFull(c.r, id); err != nil {
+		return frameHeader{}, err
+	}
+	hdr.id = string(id)
+	return hdr, nil
+}
+
+func (c *Connection) decodeFrame(hdr frameHeader, payload []byte) (RPCMessage, error) {
+	var r io.Reader = bytes.NewReader(payload)
+	if hdr.flags&frameCompressed != 0 {
+		zr, err := gzip.NewReader(r)
+		if err != nil {
+			return RPCMessage{}, err
+		}
+		defer zr.Close()
+		r = zr
+	}
+	var msg RPCMessage
+	if err := c.codec.NewDecoder(r).Decode(&msg); err != nil {
+		return RPCMessage{}, err
+	}
+	return msg, nil
+}
+
+// rejectFrame answers a skipped request with an error, or fails the local
+// waiter of a skipped response.
+func (c *Connection) rejectFrame(hdr frameHeader, code int, reason string) {
+	if hdr.id == "" {
+		return
+	}
+	errMsg := RPCMessage{
+		Type:      ResponseType,
+		ID:        hdr.id,
+		Error:     &reason,
+		ErrorCode: code,
+	}
+	switch hdr.typ {
+	case frameTypes[RequestType], frameTypes[StreamOpenType], frameTypes[ReauthType]:
+		_ = c.Send(errMsg)
+	case frameTypes[ResponseType]:
+		c.handleMessage(errMsg)
+	}
+}
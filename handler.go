@@ -6,29 +6,83 @@ import (
 
 type HandlerFunc func(ctx *Context)
 
+// PanicHandler is called after a handler panic has been recovered and an
+// error response has been sent to the caller.
+type PanicHandler func(ctx *Context, recovered any, stack []byte)
+
+// ConnectHandler is called once a connection has been authenticated and is
+// ready for calls.
+type ConnectHandler func(c *Connection)
+
+// DisconnectHandler is called once a connection is gone. reason is the error
+// that ended it, e.g. one wrapping io.EOF when the peer hung up.
+type DisconnectHandler func(c *Connection, reason error)
+
+// StreamHandlerFunc serves a bidirectional stream opened with OpenStream.
+// Returning ends the stream; a non-nil error is sent to the opener.
+type StreamHandlerFunc func(ctx *Context, stream *Stream) error
+
 type HandlerRegistry struct {
-	handlers map[string]HandlerFunc
-	mu       sync.RWMutex
+	handlers      map[string]HandlerFunc
+	streams       map[string]HandlerFunc // stream handlers adapted to HandlerFunc
+	chains        map[string]HandlerFunc // handlers wrapped by build, served by Get
+	streamChains  map[string]HandlerFunc // stream handlers wrapped by build, served by GetStream
+	middleware    []Middleware
+	policies      map[string]Policy // see Authorize
+	topicPolicies map[string]Policy // see AuthorizeTopic
+	defaultPolicy Policy
+	mu            sync.RWMutex
 }
 
 func NewHandlerRegistry() *HandlerRegistry {
 	return &HandlerRegistry{
-		handlers: make(map[string]HandlerFunc),
+		handlers:      make(map[string]HandlerFunc),
+		streams:       make(map[string]HandlerFunc),
+		chains:        make(map[string]HandlerFunc),
+		streamChains:  make(map[string]HandlerFunc),
+		policies:      make(map[string]Policy),
+		topicPolicies: make(map[string]Policy),
+	}
+}
+
+// Register registers fn for method. Per-method middleware wraps fn inside
+// any middleware added with Use.
+func (hr *HandlerRegistry) Register(method string, fn HandlerFunc, mw ...Middleware) {
+	hr.mu.Lock()
+	defer hr.mu.Unlock()
+	hr.handlers[method] = chain(fn, mw)
+	hr.chains[method] = hr.build(method, hr.handlers[method])
+}
+
+// RegisterStream registers a stream handler for method. Middleware added
+// with Use or passed here wraps it like any other handler.
+func (hr *HandlerRegistry) RegisterStream(method string, fn StreamHandlerFunc, mw ...Middleware) {
+	handler := func(ctx *Context) {
+		ctx.stream.finish(fn(ctx, ctx.stream))
 	}
+	hr.mu.Lock()
+	defer hr.mu.Unlock()
+	hr.streams[method] = chain(handler, mw)
+	hr.streamChains[method] = hr.build(method, hr.streams[method])
 }
 
-func (hr *HandlerRegistry) Register(method string, fn HandlerFunc) {
-	hr.handlers[method] = fn
+// Use appends middleware applied to every handler, including those
+// registered before the call. The first middleware is the outermost.
+func (hr *HandlerRegistry) Use(mw ...Middleware) {
+	hr.mu.Lock()
+	defer hr.mu.Unlock()
+	hr.middleware = append(hr.middleware, mw...)
+	hr.rebuild()
 }
 
 func (hr *HandlerRegistry) Handle(conn *Connection, msg RPCMessage) {
-	fn, ok := hr.handlers[msg.Method]
-	if !ok {
+	fn := hr.Get(msg.Method)
+	if fn == nil {
 		conn.Send(RPCMessage{
 			Type:      ResponseType,
 			ID:        msg.ID,
 			Error:     strPtr("method not found"),
-			ErrorCode: 404,
+			ErrorCode: ErrCodeMethodNotFound,
 		})
 		return
 	}
@@ -46,7 +100,7 @@ func (r *HandlerRegistry) HandleWithContext(ctx *Context, method string) {
 	if fn != nil {
 		fn(ctx)
 	} else {
-		ctx.WriteError(404, "method not found")
+		ctx.WriteError(ErrCodeMethodNotFound, "method not found")
 	}
 }
 
@@ -54,8 +108,36 @@ func strPtr(s string) *string {
 	return &s
 }
 
+// Get returns the handler for method wrapped in the registry middleware and
+// its authorization policy, or nil if no handler is registered.
 func (hr *HandlerRegistry) Get(method string) HandlerFunc {
 	hr.mu.RLock()
 	defer hr.mu.RUnlock()
-	return hr.handlers[method]
+	return hr.chains[method]
+}
+
+// GetStream returns the stream handler for method wrapped in the registry
+// middleware and its authorization policy, or nil if no stream handler is
+// registered.
+func (hr *HandlerRegistry) GetStream(method string) HandlerFunc {
+	hr.mu.RLock()
+	defer hr.mu.RUnlock()
+	return hr.streamChains[method]
+}
+
+// build wraps a registered handler in the registry middleware and the
+// authorization policy of method. Callers hold hr.mu.
+func (hr *HandlerRegistry) build(method string, fn HandlerFunc) HandlerFunc {
+	return hr.authorized(method, chain(fn, hr.middleware))
+}
+
+// rebuild refreshes every cached chain after the middleware or policies
+// changed. Callers hold hr.mu.
+func (hr *HandlerRegistry) rebuild() {
+	for method, fn := range hr.handlers {
+		hr.chains[method] = hr.build(method, fn)
+	}
+	for method, fn := range hr.streams {
+		hr.streamChains[method] = hr.build(method, fn)
+	}
 }
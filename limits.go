@@ -0,0 +1,217 @@
+package bidirpc
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"sync"
+	"time"
+)
+
+// DefaultHandshakeTimeout bounds the handshake of servers whose Limits do
+// not set HandshakeTimeout.
+const DefaultHandshakeTimeout = 10 * time.Second
+
+// defaultMaxAuthFailureBackoff caps the auth failure backoff unless Limits
+// sets MaxAuthFailureBackoff.
+const defaultMaxAuthFailureBackoff = 5 * time.Minute
+
+// Limits bounds the connections a Server admits. Connections over a limit
+// are closed right after accept, before any data is read. Zero fields are
+// unlimited, except HandshakeTimeout.
+type Limits struct {
+	// HandshakeTimeout is the time a connection has from accept until the
+	// server sends auth_ok, including TLS and authentication. Zero means
+	// DefaultHandshakeTimeout and a negative value disables it.
+	HandshakeTimeout time.Duration
+
+	MaxConns      int // concurrent connections, handshaking or authenticated
+	MaxConnsPerIP int // concurrent connections from one source IP
+
+	// HandshakeRate limits new connections per source IP to that many per
+	// second on average, with bursts of up to HandshakeBurst (default: the
+	// rate rounded up).
+	HandshakeRate  float64
+	HandshakeBurst int
+
+	// AuthFailureBackoff refuses connections and reauthentication from a
+	// source IP for that long after it fails either, doubling with each consecutive failure
+	// up to MaxAuthFailureBackoff (default 5 minutes). A successful
+	// authentication resets it.
+	AuthFailureBackoff    time.Duration
+	MaxAuthFailureBackoff time.Duration
+}
+
+var (
+	errTooManyConns = errors.New("too many connections")
+	errRateLimited  = errors.New("handshake rate exceeded")
+	errBackingOff   = errors.New("backing off after failed authentication")
+)
+
+// SetLimits sets the admission limits of the server. Connections already
+// admitted are not affected.
+func (s *Server) SetLimits(l Limits) {
+	s.admission.mu.Lock()
+	defer s.admission.mu.Unlock()
+	s.admission.limits = l
+}
+
+// admission tracks connections per source IP to enforce Limits.
+type admission struct {
+	mu        sync.Mutex
+	limits    Limits
+	total     int
+	peers     map[string]*peerState
+	lastSweep time.Time
+}
+
+type peerState struct {
+	conns        int
+	tokens       float64 // handshake rate bucket
+	refilled     time.Time
+	failures     int // consecutive authentication failures
+	blockedUntil time.Time
+}
+
+// handshakeDeadline returns the deadline of a handshake starting now, or the
+// zero time if there is none.
+func (a *admission) handshakeDeadline() time.Time {
+	a.mu.Lock()
+	timeout := a.limits.HandshakeTimeout
+	a.mu.Unlock()
+	if timeout == 0 {
+		timeout = DefaultHandshakeTimeout
+	}
+	if timeout < 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(timeout)
+}
+
+// admit counts a new connection from ip, or returns why it is refused.
+// Admitted connections must be released.
+func (a *admission) admit(ip string) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	now := time.Now()
+	l := a.limits
+	if a.peers == nil {
+		a.peers = make(map[string]*peerState)
+	}
+	if now.Sub(a.lastSweep) > time.Minute {
+		a.sweep(now)
+	}
+
+	if l.MaxConns > 0 && a.total >= l.MaxConns {
+		return errTooManyConns
+	}
+	p := a.peers[ip]
+	if p == nil {
+		p = &peerState{tokens: a.burst(), refilled: now}
+		a.peers[ip] = p
+	}
+	if now.Before(p.blockedUntil) {
+		return errBackingOff
+	}
+	if l.MaxConnsPerIP > 0 && p.conns >= l.MaxConnsPerIP {
+		return fmt.Errorf("%w from %s", errTooManyConns, ip)
+	}
+	if l.HandshakeRate > 0 {
+		p.tokens = min(p.tokens+now.Sub(p.refilled).Seconds()*l.HandshakeRate, a.burst())
+		p.refilled = now
+		if p.tokens < 1 {
+			return errRateLimited
+		}
+		p.tokens--
+	}
+
+	p.conns++
+	a.total++
+	return nil
+}
+
+// release uncounts a connection admitted from ip.
+func (a *admission) release(ip string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.total--
+	if p := a.peers[ip]; p != nil {
+		p.conns--
+	}
+}
+
+// authFailed starts or extends the backoff of ip.
+func (a *admission) authFailed(ip string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	p := a.peers[ip]
+	if p == nil || a.limits.AuthFailureBackoff <= 0 {
+		return
+	}
+	p.failures++
+	backoff := a.limits.AuthFailureBackoff << min(p.failures-1, 30)
+	if backoff <= 0 || backoff > a.maxBackoff() {
+		backoff = a.maxBackoff()
+	}
+	p.blockedUntil = time.Now().Add(backoff)
+}
+
+// backingOff reports whether ip is blocked after failed authentications.
+func (a *admission) backingOff(ip string) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	p := a.peers[ip]
+	return p != nil && time.Now().Before(p.blockedUntil)
+}
+
+// authSucceeded resets the backoff of ip.
+func (a *admission) authSucceeded(ip string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if p := a.peers[ip]; p != nil {
+		p.failures = 0
+	}
+}
+
+func (a *admission) burst() float64 {
+	if a.limits.HandshakeBurst > 0 {
+		return float64(a.limits.HandshakeBurst)
+	}
+	return max(math.Ceil(a.limits.HandshakeRate), 1)
+}
+
+func (a *admission) maxBackoff() time.Duration {
+	if a.limits.MaxAuthFailureBackoff > 0 {
+		return a.limits.MaxAuthFailureBackoff
+	}
+	return defaultMaxAuthFailureBackoff
+}
+
+// sweep forgets source IPs without connections whose rate bucket is full
+// and whose failures are old enough not to matter. Callers hold a.mu.
+func (a *admission) sweep(now time.Time) {
+	a.lastSweep = now
+	refill := time.Duration(0)
+	if a.limits.HandshakeRate > 0 {
+		refill = time.Duration(a.burst() / a.limits.HandshakeRate * float64(time.Second))
+	}
+	for ip, p := range a.peers {
+		if p.conns == 0 && now.Sub(p.refilled) >= refill && now.After(p.blockedUntil.Add(a.maxBackoff())) {
+			delete(a.peers, ip)
+		}
+	}
+}
+
+// remoteIP returns the source IP of conn, used to apply per-IP limits.
+func remoteIP(conn net.Conn) string {
+	addr := conn.RemoteAddr()
+	if tcp, ok := addr.(*net.TCPAddr); ok {
+		return tcp.IP.String()
+	}
+	if host, _, err := net.SplitHostPort(addr.String()); err == nil {
+		return host
+	}
+	return addr.String()
+}
@@ -9,6 +9,19 @@ const (
 	AuthErrType  MessageType = "auth_error"
 	RequestType  MessageType = "request"
 	ResponseType MessageType = "response"
+	CancelType   MessageType = "cancel" // caller gave up on the request with the same ID
+	StreamType   MessageType = "stream" // one item of a streamed response; a response ends the stream
+
+	StreamOpenType  MessageType = "stream_open"  // opens a bidirectional stream to a stream handler
+	StreamCloseType MessageType = "stream_close" // the opener of a stream has finished sending
+
+	NotificationType MessageType = "notification" // a request without ID that gets no response
+
+	SubscribeType   MessageType = "subscribe"   // the sender wants publishes on the topic in Method
+	UnsubscribeType MessageType = "unsubscribe" // the sender no longer wants the topic in Method
+	PublishType     MessageType = "publish"     // Result carries a payload for the topic in Method
+
+	ReauthType MessageType = "reauth" // the client presents a fresh token in Params["token"]
 )
 
 // RPCMessage is used for the exchange of RPC requests and responses.
@@ -21,3 +34,15 @@ type RPCMessage struct {
 	Error     *string        `json:"error,omitempty"`
 	ErrorCode int            `json:"errorCode,omitempty"`
 }
+
+// Error codes sent by the library itself.
+const (
+	ErrCodeBadRequest     = 400 // params could not be decoded
+	ErrCodeUnauthorized   = 401 // the token of a reauth message was refused
+	ErrCodeForbidden      = 403 // refused by the method's authorization policy
+	ErrCodeMethodNotFound = 404
+	ErrCodeTooLarge       = 413 // the frame exceeded the peer's maximum size
+	ErrCodeInternal       = 500 // a typed handler returned a plain error
+	ErrCodeHandlerPanic   = 520 // the handler panicked; see Server.OnPanic
+	ErrCodeUnavailable    = 503
+)
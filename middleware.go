@@ -0,0 +1,53 @@
+package bidirpc
+
+import (
+	"context"
+	"sync"
+)
+
+// Middleware wraps a HandlerFunc, e.g. for logging, auth checks or metrics.
+type Middleware func(HandlerFunc) HandlerFunc
+
+// chain wraps fn so that mw[0] runs first.
+func chain(fn HandlerFunc, mw []Middleware) HandlerFunc {
+	for i := len(mw) - 1; i >= 0; i-- {
+		fn = mw[i](fn)
+	}
+	return fn
+}
+
+// Invoker performs an outgoing call and returns its result.
+type Invoker func(ctx context.Context, method string, params map[string]any) (any, error)
+
+// Interceptor wraps outgoing calls made through a Connection. It may inspect
+// or modify the request, call next, and inspect or replace the result.
+type Interceptor func(next Invoker) Invoker
+
+// interceptorChain is a list of interceptors. Each connection has its own
+// chain whose parent is the chain shared by the connections of its Server or
+// AutoClient.
+type interceptorChain struct {
+	parent *interceptorChain // runs outside this chain; may be nil
+	mu     sync.RWMutex
+	list   []Interceptor
+}
+
+func (ic *interceptorChain) use(interceptors ...Interceptor) {
+	ic.mu.Lock()
+	defer ic.mu.Unlock()
+	ic.list = append(ic.list, interceptors...)
+}
+
+// wrap returns base wrapped so that the first interceptor runs first, after
+// those of the parent chain.
+func (ic *interceptorChain) wrap(base Invoker) Invoker {
+	ic.mu.RLock()
+	for i := len(ic.list) - 1; i >= 0; i-- {
+		base = ic.list[i](base)
+	}
+	ic.mu.RUnlock()
+	if ic.parent != nil {
+		base = ic.parent.wrap(base)
+	}
+	return base
+}
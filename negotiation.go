@@ -1,21 +1,132 @@
 package bidirpc
 
 import (
+	"bufio"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
 )
 
+// ProtocolVersion is the protocol version spoken by this package. Version 1
+// peers predate capability negotiation and only understand UseCompression.
+const ProtocolVersion = 2
+
+// CompressionGzip is the only compression algorithm currently supported.
+const CompressionGzip = "gzip"
+
 // NegotiationMessage is used for the initial handshake between client and server.
 type NegotiationMessage struct {
-	Type           MessageType `json:"type"`                     // Message type: auth_request, auth_ok, etc.
-	ClientID       string      `json:"clientID,omitempty"`       // Sent by client
-	AuthCode       string      `json:"authCode,omitempty"`       // Sent by client
-	UseCompression bool        `json:"useCompression,omitempty"` // Request or confirm gzip compression
+	Type           MessageType   `json:"type"`                     // Message type: auth_request, auth_ok, etc.
+	ClientID       string        `json:"clientID,omitempty"`       // Sent by client
+	AuthCode       string        `json:"authCode,omitempty"`       // Sent by client
+	UseCompression bool          `json:"useCompression,omitempty"` // Request or confirm gzip compression (version 1)
+	Version        int           `json:"version,omitempty"`        // Protocol version; 0 means version 1
+	Capabilities   *Capabilities `json:"capabilities,omitempty"`   // Offered by the client, agreed set in auth_ok
+	SessionID      string        `json:"sessionId,omitempty"`      // Assigned by the server in auth_ok
+	Reason         string        `json:"reason,omitempty"`         // Why authentication failed
+	ReasonCode     string        `json:"reasonCode,omitempty"`     // Machine-readable Reason, see AuthError
+	AuthMethod     string        `json:"authMethod,omitempty"`     // AuthMethodHMAC for challenge-response; empty for AuthCode
+	Nonce          []byte        `json:"nonce,omitempty"`          // Sent by the server in auth_challenge
+	Proof          []byte        `json:"proof,omitempty"`          // Sent by the client in auth_response
+	Token          string        `json:"token,omitempty"`          // Bearer token sent by the client
+	ExpiresAt      *time.Time    `json:"expiresAt,omitempty"`      // When the credentials lapse, in auth_ok
+}
+
+// Capabilities lists optional protocol features. The client offers what it
+// supports and the server answers with the intersection in auth_ok.
+type Capabilities struct {
+	Codecs         []string `json:"codecs,omitempty"`         // Most preferred first; the agreed set has one entry
+	Compression    []string `json:"compression,omitempty"`    // Most preferred first; the agreed set has at most one entry
+	Framing        bool     `json:"framing,omitempty"`        // Length-prefixed frames, see EnableFraming
+	Cancellation   bool     `json:"cancellation,omitempty"`   // Peer understands cancel messages
+	Streaming      bool     `json:"streaming,omitempty"`      // Peer understands stream messages
+	MaxMessageSize int      `json:"maxMessageSize,omitempty"` // Largest message accepted, enforced in framed mode
+}
+
+// legacyCapabilities describes what a version 1 peer supports.
+func legacyCapabilities(useCompression bool) Capabilities {
+	var caps Capabilities
+	if useCompression {
+		caps.Compression = []string{CompressionGzip}
+	}
+	return caps
+}
+
+// ApplyNegotiation configures the connection from an auth_ok message:
+// codec, framing and compression are switched on as agreed. Both peers call
+// it after the handshake, before StartReadLoop.
+func (c *Connection) ApplyNegotiation(resp NegotiationMessage) error {
+	caps := legacyCapabilities(resp.UseCompression)
+	if resp.Capabilities != nil {
+		caps = *resp.Capabilities
+	}
+	version := resp.Version
+	if version == 0 {
+		version = 1
+	}
+
+	codec := GetCodec(CodecJSON)
+	if len(caps.Codecs) > 0 {
+		if codec = GetCodec(caps.Codecs[0]); codec == nil {
+			return fmt.Errorf("unknown codec %q", caps.Codecs[0])
+		}
+	}
+	if len(caps.Compression) > 0 && caps.Compression[0] != CompressionGzip {
+		return fmt.Errorf("unsupported compression %q", caps.Compression[0])
+	}
+
+	c.SetCodec(codec)
+	if caps.Framing {
+		c.EnableFraming(caps.MaxMessageSize)
+	}
+	if len(caps.Compression) > 0 {
+		if err := c.EnableCompression(); err != nil {
+			return err
+		}
+	}
+
+	c.initMu.Lock()
+	c.caps = caps
+	c.version = version
+	c.initMu.Unlock()
+	if resp.SessionID != "" {
+		c.sessionID = resp.SessionID
+	}
+	if resp.ExpiresAt != nil {
+		c.setExpiry(*resp.ExpiresAt, false)
+	}
+	return nil
+}
+
+// Capabilities returns the capabilities agreed during the handshake.
+func (c *Connection) Capabilities() Capabilities {
+	c.initMu.Lock()
+	defer c.initMu.Unlock()
+	return c.caps
+}
+
+// ClientID returns the ID the client authenticated with.
+func (c *Connection) ClientID() string {
+	return c.clientID
 }
 
+// ProtocolVersion returns the protocol version agreed during the handshake.
+func (c *Connection) ProtocolVersion() int {
+	c.initMu.Lock()
+	defer c.initMu.Unlock()
+	return c.version
+}
+
+// ErrAuthFailed is reported when the server rejects a client's credentials.
+var ErrAuthFailed = errors.New("authentication failed")
+
 // Negotiation message types
 const (
-	AuthRequestType = "auth_request"
-	AuthFailType    = "auth_fail"
+	AuthRequestType   = "auth_request"
+	AuthFailType      = "auth_fail"
+	AuthChallengeType = "auth_challenge" // server nonce for AuthMethodHMAC
+	AuthResponseType  = "auth_response"  // client proof for AuthMethodHMAC
 )
 
 // SendNegotiation sends a negotiation message directly (without compression).
@@ -23,7 +134,31 @@ func (c *Connection) SendNegotiation(msg NegotiationMessage) error {
 	return json.NewEncoder(c.Conn).Encode(msg)
 }
 
+// maxNegotiationSize bounds a negotiation message. It leaves room for bearer
+// tokens with a fair number of claims.
+const maxNegotiationSize = 16 << 10
+
+// ErrNegotiationTooLarge is returned by ReceiveNegotiation for messages over
+// the size limit, which fails the handshake.
+var ErrNegotiationTooLarge = errors.New("negotiation message too large")
+
 // ReceiveNegotiation reads a negotiation message directly from the raw connection.
+// Exactly one line is consumed so that data sent right after the handshake
+// is left for the message decoder.
 func (c *Connection) ReceiveNegotiation(msg *NegotiationMessage) error {
-	return json.NewDecoder(c.Conn).Decode(msg)
+	var line []byte
+	for {
+		chunk, err := c.r.ReadSlice('\n')
+		if len(line)+len(chunk) > maxNegotiationSize {
+			return ErrNegotiationTooLarge
+		}
+		line = append(line, chunk...)
+		if err == nil {
+			break
+		}
+		if !errors.Is(err, bufio.ErrBufferFull) {
+			return err
+		}
+	}
+	return json.Unmarshal(line, msg)
 }
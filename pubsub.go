@@ -0,0 +1,146 @@
+package bidirpc
+
+import (
+	"log"
+	"maps"
+	"slices"
+	"sync"
+)
+
+// TopicHandler receives the payloads published by the peer on a topic. The
+// context identifies the publisher; responses written to it are discarded.
+type TopicHandler func(ctx *Context, payload any)
+
+// topicRegistry holds the local handler of each subscribed topic. Like the
+// handler registry, it is shared by every connection of a Server or AutoClient.
+type topicRegistry struct {
+	handlers map[string]TopicHandler
+	mu       sync.RWMutex
+}
+
+func newTopicRegistry() *topicRegistry {
+	return &topicRegistry{handlers: make(map[string]TopicHandler)}
+}
+
+func (tr *topicRegistry) set(topic string, fn TopicHandler) {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	tr.handlers[topic] = fn
+}
+
+func (tr *topicRegistry) remove(topic string) {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	delete(tr.handlers, topic)
+}
+
+func (tr *topicRegistry) get(topic string) TopicHandler {
+	tr.mu.RLock()
+	defer tr.mu.RUnlock()
+	return tr.handlers[topic]
+}
+
+func (tr *topicRegistry) names() []string {
+	tr.mu.RLock()
+	defer tr.mu.RUnlock()
+	return slices.Collect(maps.Keys(tr.handlers))
+}
+
+// Subscribe registers fn for topic and asks the peer to publish it to us.
+// Subscribing again replaces the handler.
+func (c *Connection) Subscribe(topic string, fn TopicHandler) error {
+	c.topics.set(topic, fn)
+	return c.sendTopic(SubscribeType, topic)
+}
+
+// Unsubscribe removes the handler for topic and tells the peer to stop
+// publishing it.
+func (c *Connection) Unsubscribe(topic string) error {
+	c.topics.remove(topic)
+	return c.sendTopic(UnsubscribeType, topic)
+}
+
+// Publish sends payload to the peer if it is subscribed to topic. Publishing
+// to a topic without subscriber is not an error.
+func (c *Connection) Publish(topic string, payload any) error {
+	if !c.PeerSubscribed(topic) {
+		return nil
+	}
+	return c.Send(RPCMessage{
+		Type:   PublishType,
+		Method: topic,
+		Result: payload,
+	})
+}
+
+// PeerSubscribed reports whether the peer is subscribed to topic.
+func (c *Connection) PeerSubscribed(topic string) bool {
+	c.topicsMu.Lock()
+	defer c.topicsMu.Unlock()
+	_, ok := c.peerTopics[topic]
+	return ok
+}
+
+// PeerTopics returns the topics the peer is subscribed to, sorted.
+func (c *Connection) PeerTopics() []string {
+	c.topicsMu.Lock()
+	topics := slices.Collect(maps.Keys(c.peerTopics))
+	c.topicsMu.Unlock()
+	slices.Sort(topics)
+	return topics
+}
+
+// sendTopic sends a subscribe or unsubscribe message. Version 1 peers do
+// not know them and get ErrNotificationsUnsupported instead.
+func (c *Connection) sendTopic(typ MessageType, topic string) error {
+	if c.ProtocolVersion() < 2 {
+		return ErrNotificationsUnsupported
+	}
+	return c.Send(RPCMessage{Type: typ, Method: topic})
+}
+
+// announceTopics subscribes the peer to every local topic, e.g. on a new
+// connection. Version 1 peers are skipped.
+func (c *Connection) announceTopics() {
+	if c.ProtocolVersion() < 2 {
+		return
+	}
+	for _, topic := range c.topics.names() {
+		if err := c.sendTopic(SubscribeType, topic); err != nil {
+			log.Printf("[conn] failed to subscribe to %s: %v", topic, err)
+			return
+		}
+	}
+}
+
+// handleTopicMessage serves subscribe, unsubscribe and publish messages.
+// Subscriptions and publishes refused by the topic policy are dropped.
+func (c *Connection) handleTopicMessage(msg RPCMessage) {
+	if msg.Type != UnsubscribeType && !c.handlers.topicAllowed(msg.Method, c.Identity()) {
+		log.Printf("[conn] %s on topic %s from %s refused by policy", msg.Type, msg.Method, c.clientID)
+		return
+	}
+
+	switch msg.Type {
+	case SubscribeType:
+		c.topicsMu.Lock()
+		c.peerTopics[msg.Method] = struct{}{}
+		c.topicsMu.Unlock()
+
+	case UnsubscribeType:
+		c.topicsMu.Lock()
+		delete(c.peerTopics, msg.Method)
+		c.topicsMu.Unlock()
+
+	case PublishType:
+		fn := c.topics.get(msg.Method)
+		if fn == nil {
+			return
+		}
+		ctx := c.newContext(msg)
+		ctx.notification = true
+		c.startHandler(ctx, msg.Method, func(ctx *Context) {
+			fn(ctx, msg.Result)
+		})
+	}
+}
@@ -1,45 +1,182 @@
 package bidirpc
 
 import (
+	"context"
 	"crypto/tls"
+	"errors"
 	"fmt"
 	"log"
+	"maps"
 	"net"
+	"slices"
 	"sync"
+	"sync/atomic"
 	"time"
+
+	"github.com/google/uuid"
 )
 
 const (
 	DefaultHeartbeatTimeout = 40 * time.Second
 )
 
+// ErrServerClosed is returned by Serve and ServeListener after Shutdown or Close.
+var ErrServerClosed = errors.New("server closed")
+
+// ErrHeartbeatTimeout is the disconnect reason of a client that stopped
+// pinging for longer than DefaultHeartbeatTimeout.
+var ErrHeartbeatTimeout = errors.New("heartbeat timeout")
+
 type Server struct {
-	authFunc  func(clientID, authCode string) bool
-	handlers  *HandlerRegistry
-	clients   map[string]*Connection
-	lastPing  map[string]time.Time
-	clientsMu sync.RWMutex
+	auth         Authenticator
+	handlers     *HandlerRegistry
+	topics       *topicRegistry
+	interceptors *interceptorChain
+	panicHook    atomic.Value // stores PanicHandler
+	connectHook  atomic.Value // stores ConnectHandler
+	discHook     atomic.Value // stores DisconnectHandler
+	authFailHook atomic.Value // stores func(clientID string, addr net.Addr, err error)
+	callPolicy   atomic.Value // stores CallPolicy
+	codecs       []string     // accepted codecs; nil means every registered codec
+	maxFrameSize int
+	clients      map[string]*Connection   // current session of each client ID
+	sessions     map[string]*Connection   // every session by session ID
+	byClient     map[string][]*Connection // sessions of each client ID, oldest first
+	joining      map[string]*Connection   // client IDs claimed by pending handshakes
+	dupPolicy    DuplicatePolicy
+	dupHook      atomic.Value // stores DuplicateHandler
+	lastPing     map[string]time.Time
+	conns        map[*Connection]struct{}       // every authenticated connection
+	groups       map[string]map[string]struct{} // group name -> client IDs
+	clientsMu    sync.RWMutex
+	listeners    map[net.Listener]struct{}
+	handshakes   map[net.Conn]struct{} // connections still negotiating
+	mu           sync.Mutex            // protects listeners and handshakes
+	inShutdown   atomic.Bool
+	admission    admission // see SetLimits
 }
 
 // NewServer creates a new RPC server with address and authentication function.
+// authFunc may be nil if an Authenticator is set with SetAuthenticator.
 func NewServer(authFunc func(clientID, authCode string) bool) *Server {
 	s := &Server{
-		authFunc: authFunc,
-		handlers: NewHandlerRegistry(),
-		clients:  make(map[string]*Connection),
-		lastPing: make(map[string]time.Time),
+		auth:         checkFunc(authFunc),
+		handlers:     NewHandlerRegistry(),
+		topics:       newTopicRegistry(),
+		interceptors: &interceptorChain{},
+		clients:      make(map[string]*Connection),
+		sessions:     make(map[string]*Connection),
+		byClient:     make(map[string][]*Connection),
+		joining:      make(map[string]*Connection),
+		lastPing:     make(map[string]time.Time),
+		conns:        make(map[*Connection]struct{}),
+		groups:       make(map[string]map[string]struct{}),
+		listeners:    make(map[net.Listener]struct{}),
+		handshakes:   make(map[net.Conn]struct{}),
 	}
 	s.RegisterHandler("Ping", s.handlePing)
+	// Heartbeats must keep working under a deny-by-default policy
+	s.handlers.Authorize("Ping", func(*Identity) bool { return true })
 	return s
 }
 
-// RegisterHandler registers an RPC handler.
-func (s *Server) RegisterHandler(method string, fn HandlerFunc) {
-	s.handlers.Register(method, fn)
+// RegisterHandler registers an RPC handler, optionally wrapped in per-method middleware.
+func (s *Server) RegisterHandler(method string, fn HandlerFunc, mw ...Middleware) {
+	s.handlers.Register(method, fn, mw...)
+}
+
+// RegisterStreamHandler registers a handler for streams opened by clients
+// with OpenStream.
+func (s *Server) RegisterStreamHandler(method string, fn StreamHandlerFunc, mw ...Middleware) {
+	s.handlers.RegisterStream(method, fn, mw...)
+}
+
+// RegisterService registers the exported methods of svc as "name.Method"
+// handlers. See HandlerRegistry.RegisterService.
+func (s *Server) RegisterService(name string, svc any) error {
+	return s.handlers.RegisterService(name, svc)
+}
+
+// Handlers returns the registry shared by all client connections, e.g. for
+// use with Handle.
+func (s *Server) Handlers() *HandlerRegistry {
+	return s.handlers
+}
+
+// Use appends middleware applied to every handler of the server.
+func (s *Server) Use(mw ...Middleware) {
+	s.handlers.Use(mw...)
+}
+
+// OnPanic sets a hook called with the stack trace whenever a handler panics.
+// The panic is always recovered and reported to the caller as ErrCodeHandlerPanic.
+func (s *Server) OnPanic(fn PanicHandler) {
+	s.panicHook.Store(fn)
+}
+
+func (s *Server) handlePanic(ctx *Context, recovered any, stack []byte) {
+	if fn, _ := s.panicHook.Load().(PanicHandler); fn != nil {
+		fn(ctx, recovered, stack)
+	}
+}
+
+// OnConnect sets a function called when a client has authenticated and its
+// connection is ready.
+func (s *Server) OnConnect(fn ConnectHandler) {
+	s.connectHook.Store(fn)
+}
+
+// OnDisconnect sets a function called as soon as a client connection is
+// gone, after the client has been removed from the server. It is never
+// called before the OnConnect call for the same connection has returned.
+func (s *Server) OnDisconnect(fn DisconnectHandler) {
+	s.discHook.Store(fn)
+}
+
+// OnAuthFailed sets a function called when a client fails authentication,
+// during the handshake or when reauthenticating.
+func (s *Server) OnAuthFailed(fn func(clientID string, addr net.Addr, err error)) {
+	s.authFailHook.Store(fn)
+}
+
+// authFailed extends the backoff of ip and runs the OnAuthFailed hook.
+func (s *Server) authFailed(clientID string, addr net.Addr, ip string, err error) {
+	s.admission.authFailed(ip)
+	if fn, _ := s.authFailHook.Load().(func(string, net.Addr, error)); fn != nil {
+		fn(clientID, addr, err)
+	}
+}
+
+// UseInterceptor appends interceptors run around every call the server makes
+// to its clients.
+func (s *Server) UseInterceptor(interceptors ...Interceptor) {
+	s.interceptors.use(interceptors...)
 }
 
 // ServeConn handles an incoming client connection.
 func (s *Server) ServeConn(conn net.Conn) {
+	if !s.trackHandshake(conn, true) {
+		conn.Close()
+		return
+	}
+	defer s.trackHandshake(conn, false)
+
+	ip := remoteIP(conn)
+	if err := s.admission.admit(ip); err != nil {
+		log.Printf("[server] refused connection from %s: %v", conn.RemoteAddr(), err)
+		conn.Close()
+		return
+	}
+	admitted := false
+	defer func() {
+		if !admitted {
+			s.admission.release(ip)
+		}
+	}()
+	if deadline := s.admission.handshakeDeadline(); !deadline.IsZero() {
+		_ = conn.SetDeadline(deadline)
+	}
+
 	c := NewConnection(conn)
 
 	// Read negotiation message
@@ -56,21 +193,54 @@ func (s *Server) ServeConn(conn net.Conn) {
 		return
 	}
 
-	if !s.authFunc(negMsg.ClientID, negMsg.AuthCode) {
-		log.Println("[server] authentication failed for client:", negMsg.ClientID)
-		resp := NegotiationMessage{Type: AuthFailType}
-		_ = c.SendNegotiation(resp)
+	// Never trust a nonce or proof sent before the challenge
+	negMsg.Nonce, negMsg.Proof = nil, nil
+	if negMsg.AuthMethod == AuthMethodHMAC {
+		if err := s.challenge(c, &negMsg); err != nil {
+			log.Println("[server] challenge failed:", err)
+			conn.Close()
+			return
+		}
+	}
+
+	identity, err := s.authenticate(c, negMsg)
+	if err != nil {
+		log.Printf("[server] authentication failed for client %s: %v", negMsg.ClientID, err)
+		s.authFailed(negMsg.ClientID, conn.RemoteAddr(), ip, err)
+		_ = c.SendNegotiation(authFailure(err))
+		conn.Close()
+		return
+	}
+
+	s.admission.authSucceeded(ip)
+	c.clientID = identity.ClientID
+	c.identity.Store(identity)
+	c.sessionID = uuid.NewString()
+
+	if existing := s.reserve(c); existing != nil {
+		s.duplicateClient(existing, c, DuplicateReject)
+		_ = c.SendNegotiation(authFailure(errDuplicateClient))
 		conn.Close()
 		return
 	}
+	defer s.unreserve(c)
 
-	c.clientID = negMsg.ClientID
-	s.lastPing[negMsg.ClientID] = time.Now()
+	offer := legacyCapabilities(negMsg.UseCompression)
+	if negMsg.Capabilities != nil {
+		offer = *negMsg.Capabilities
+	}
+	agreed := s.negotiateCapabilities(offer)
 
 	// Send AuthOK (without compression yet)
 	resp := NegotiationMessage{
 		Type:           AuthOKType,
-		UseCompression: negMsg.UseCompression,
+		UseCompression: len(agreed.Compression) > 0,
+		Version:        min(max(negMsg.Version, 1), ProtocolVersion),
+		Capabilities:   &agreed,
+		SessionID:      c.sessionID,
+	}
+	if !identity.ExpiresAt.IsZero() {
+		resp.ExpiresAt = &identity.ExpiresAt
 	}
 	if err := c.SendNegotiation(resp); err != nil {
 		log.Println("[server] failed to send AuthOK:", err)
@@ -78,39 +248,229 @@ func (s *Server) ServeConn(conn net.Conn) {
 		return
 	}
 
-	// Enable compression if agreed
-	if negMsg.UseCompression {
-		if err := c.EnableCompression(); err != nil {
-			log.Println("[server] failed to enable compression:", err)
-			conn.Close()
-			return
-		}
+	_ = conn.SetDeadline(time.Time{})
+
+	// Switch codec, framing and compression as agreed
+	if err := c.ApplyNegotiation(resp); err != nil {
+		log.Println("[server] failed to apply negotiation:", err)
+		conn.Close()
+		return
 	}
 
 	c.handlers = s.handlers
+	c.topics = s.topics
+	c.interceptors = &interceptorChain{parent: s.interceptors}
+	c.onPanic = s.handlePanic
+	c.callPolicy = s.allowCall
+	c.reauth = func(token string) (*Identity, error) { return s.reauthenticate(c, token) }
 
-	s.clientsMu.Lock()
-	s.clients[negMsg.ClientID] = c
-	s.clientsMu.Unlock()
+	existing, policy, ok := s.admit(c)
+	if existing != nil {
+		s.duplicateClient(existing, c, policy)
+	}
+	if !ok {
+		conn.Close()
+		return
+	}
+	if existing != nil && policy == DuplicateKickOld {
+		_ = existing.closeWithReason(ErrSessionReplaced)
+	}
 
-	log.Println("[server] client connected:", negMsg.ClientID)
+	log.Println("[server] client connected:", c.clientID)
 
+	connected := make(chan struct{})
+	admitted = true
+	c.onDisconnect = func(reason error) {
+		<-connected
+		s.admission.release(ip)
+		s.forget(c)
+		log.Printf("[server] client %s disconnected: %v", c.clientID, reason)
+		if fn, _ := s.discHook.Load().(DisconnectHandler); fn != nil {
+			fn(c, reason)
+		}
+	}
+
+	c.setIdentity(identity)
 	c.StartReadLoop()
+	c.announceTopics()
+	if fn, _ := s.connectHook.Load().(ConnectHandler); fn != nil {
+		fn(c)
+	}
+	close(connected)
+}
+
+// SetCodecs restricts the codecs the server accepts during negotiation.
+// By default every registered codec is accepted. JSON is always accepted
+// as a fallback for clients that offer nothing else.
+func (s *Server) SetCodecs(names ...string) {
+	s.clientsMu.Lock()
+	defer s.clientsMu.Unlock()
+	s.codecs = names
+}
+
+// SetMaxFrameSize sets the largest message accepted from clients using framed
+// mode. Clients sending a larger frame are disconnected.
+func (s *Server) SetMaxFrameSize(n int) {
+	s.clientsMu.Lock()
+	defer s.clientsMu.Unlock()
+	s.maxFrameSize = n
+}
+
+func (s *Server) frameLimit() int {
+	s.clientsMu.RLock()
+	defer s.clientsMu.RUnlock()
+	if s.maxFrameSize <= 0 {
+		return DefaultMaxFrameSize
+	}
+	return s.maxFrameSize
+}
+
+// negotiateCapabilities returns the subset of offer the server supports.
+func (s *Server) negotiateCapabilities(offer Capabilities) Capabilities {
+	agreed := Capabilities{
+		Framing:        offer.Framing,
+		Cancellation:   offer.Cancellation,
+		Streaming:      offer.Streaming,
+		MaxMessageSize: s.frameLimit(),
+	}
+	if offer.MaxMessageSize > 0 && offer.MaxMessageSize < agreed.MaxMessageSize {
+		agreed.MaxMessageSize = offer.MaxMessageSize
+	}
+	if len(offer.Codecs) > 0 {
+		agreed.Codecs = []string{s.selectCodec(offer.Codecs).Name()}
+	}
+	if slices.Contains(offer.Compression, CompressionGzip) {
+		agreed.Compression = []string{CompressionGzip}
+	}
+	return agreed
+}
+
+// selectCodec returns the first offered codec the server accepts.
+func (s *Server) selectCodec(offered []string) Codec {
+	s.clientsMu.RLock()
+	allowed := s.codecs
+	s.clientsMu.RUnlock()
+
+	for _, name := range offered {
+		if allowed != nil && !slices.Contains(allowed, name) {
+			continue
+		}
+		if codec := GetCodec(name); codec != nil {
+			return codec
+		}
+	}
+	return GetCodec(CodecJSON)
+}
+
+// trackHandshake registers or unregisters a connection that has not finished
+// negotiating yet. It reports false if the server is shutting down.
+func (s *Server) trackHandshake(conn net.Conn, add bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !add {
+		delete(s.handshakes, conn)
+		return true
+	}
+	if s.shuttingDown() {
+		return false
+	}
+	s.handshakes[conn] = struct{}{}
+	return true
+}
 
-	// When connection dies, cleanup
+func (s *Server) trackListener(ln net.Listener, add bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !add {
+		delete(s.listeners, ln)
+		return true
+	}
+	if s.shuttingDown() {
+		return false
+	}
+	s.listeners[ln] = struct{}{}
+	return true
+}
+
+func (s *Server) shuttingDown() bool {
+	return s.inShutdown.Load()
+}
+
+// Shutdown gracefully stops the server. It closes all listeners, aborts
+// pending handshakes and stops dispatching new requests, then waits for
+// in-flight handlers to return before closing every client connection.
+// If ctx expires first, running handlers are cancelled through
+// Context.Context, connections are closed and ctx.Err() is returned.
+func (s *Server) Shutdown(ctx context.Context) error {
+	conns := s.beginShutdown()
+
+	drained := make(chan struct{})
 	go func() {
-		for {
-			time.Sleep(1 * time.Second)
-			if c.Dec == nil {
-				break
-			}
+		for _, c := range conns {
+			<-c.drain()
 		}
-		log.Println("[server] disconnected:", negMsg.ClientID)
-		s.clientsMu.Lock()
-		delete(s.clients, negMsg.ClientID)
-		delete(s.lastPing, negMsg.ClientID)
-		s.clientsMu.Unlock()
+		close(drained)
 	}()
+
+	var err error
+	select {
+	case <-drained:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	s.closeClients()
+	return err
+}
+
+// Close immediately stops the server, closing all listeners and client
+// connections without waiting for in-flight handlers.
+func (s *Server) Close() error {
+	s.beginShutdown()
+	s.closeClients()
+	return nil
+}
+
+// beginShutdown marks the server as shutting down, closes listeners and
+// pending handshakes, and returns a snapshot of the active connections.
+func (s *Server) beginShutdown() []*Connection {
+	s.clientsMu.Lock()
+	s.inShutdown.Store(true)
+	conns := make([]*Connection, 0, len(s.conns))
+	for c := range s.conns {
+		conns = append(conns, c)
+	}
+	s.clientsMu.Unlock()
+
+	s.mu.Lock()
+	for ln := range s.listeners {
+		_ = ln.Close()
+		delete(s.listeners, ln)
+	}
+	for conn := range s.handshakes {
+		_ = conn.Close()
+		delete(s.handshakes, conn)
+	}
+	s.mu.Unlock()
+
+	return conns
+}
+
+// closeClients closes and forgets every client connection.
+func (s *Server) closeClients() {
+	s.clientsMu.Lock()
+	conns := s.conns
+	s.conns = make(map[*Connection]struct{})
+	s.clients = make(map[string]*Connection)
+	s.sessions = make(map[string]*Connection)
+	s.byClient = make(map[string][]*Connection)
+	s.lastPing = make(map[string]time.Time)
+	s.groups = make(map[string]map[string]struct{})
+	s.clientsMu.Unlock()
+
+	for c := range conns {
+		_ = c.closeWithReason(ErrServerClosed)
+	}
 }
 
 // handlePing updates the lastPing time and replies with "pong".
@@ -123,27 +483,215 @@ func (s *Server) handlePing(ctx *Context) {
 }
 
 // GetClientByID returns the active connection for a given client.
-// If the last ping is too old, the client is considered inactive.
+// If the last ping is too old, the client is considered inactive and its
+// connection is closed with ErrHeartbeatTimeout.
 func (s *Server) GetClientByID(clientID string) *Connection {
-	s.clientsMu.Lock()
-	defer s.clientsMu.Unlock()
-
+	s.clientsMu.RLock()
 	conn, ok := s.clients[clientID]
+	lastPing := s.lastPing[clientID]
+	s.clientsMu.RUnlock()
 	if !ok {
 		return nil
 	}
 
-	lastPing, ok := s.lastPing[clientID]
-	if !ok || time.Since(lastPing) > DefaultHeartbeatTimeout {
+	if time.Since(lastPing) > DefaultHeartbeatTimeout {
 		log.Printf("[server] client %s considered inactive (last ping > %v)", clientID, DefaultHeartbeatTimeout)
-		delete(s.clients, clientID)
-		delete(s.lastPing, clientID)
+		_ = conn.closeWithReason(ErrHeartbeatTimeout)
 		return nil
 	}
 
 	return conn
 }
 
+// ListClientIDs returns the IDs of the active clients, sorted.
+func (s *Server) ListClientIDs() []string {
+	ids := slices.Collect(maps.Keys(s.activeClients()))
+	slices.Sort(ids)
+	return ids
+}
+
+// activeClients returns the connected clients whose last ping is recent.
+func (s *Server) activeClients() map[string]*Connection {
+	s.clientsMu.Lock()
+	defer s.clientsMu.Unlock()
+
+	active := make(map[string]*Connection, len(s.clients))
+	for id, conn := range s.clients {
+		if time.Since(s.lastPing[id]) <= DefaultHeartbeatTimeout {
+			active[id] = conn
+		}
+	}
+	return active
+}
+
+// Broadcast sends a notification to every active client. Failed sends are
+// joined into the returned error.
+func (s *Server) Broadcast(method string, params map[string]any) error {
+	return fanOut(s.activeClients(), func(c *Connection) error {
+		return c.Notify(method, params)
+	})
+}
+
+// fanOut calls send for each of conns concurrently and joins the errors.
+func fanOut(conns map[string]*Connection, send func(*Connection) error) error {
+	var (
+		mu   sync.Mutex
+		errs []error
+		wg   sync.WaitGroup
+	)
+	for id, conn := range conns {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := send(conn); err != nil {
+				mu.Lock()
+				errs = append(errs, fmt.Errorf("client %s: %w", id, err))
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
+
+// MulticastResult is the outcome of a Multicast call for one client.
+type MulticastResult struct {
+	Result any
+	Err    error
+}
+
+// Multicast calls method on each of the given clients concurrently and
+// waits for all of them, up to timeout each. The result for every ID is
+// returned, including clients that are not connected.
+func (s *Server) Multicast(ids []string, method string, params map[string]any, timeout time.Duration) map[string]MulticastResult {
+	var (
+		mu      sync.Mutex
+		results = make(map[string]MulticastResult, len(ids))
+		wg      sync.WaitGroup
+	)
+	for _, id := range ids {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			res, err := s.Call(id, method, params, timeout)
+			mu.Lock()
+			results[id] = MulticastResult{Result: res, Err: err}
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+	return results
+}
+
+// JoinGroup adds a connected client to group. Membership lasts until the
+// client leaves the group or disconnects.
+func (s *Server) JoinGroup(clientID, group string) error {
+	s.clientsMu.Lock()
+	defer s.clientsMu.Unlock()
+
+	if _, ok := s.clients[clientID]; !ok {
+		return fmt.Errorf("client %s is not connected", clientID)
+	}
+	members, ok := s.groups[group]
+	if !ok {
+		members = make(map[string]struct{})
+		s.groups[group] = members
+	}
+	members[clientID] = struct{}{}
+	return nil
+}
+
+// LeaveGroup removes a client from group.
+func (s *Server) LeaveGroup(clientID, group string) {
+	s.clientsMu.Lock()
+	defer s.clientsMu.Unlock()
+
+	members := s.groups[group]
+	delete(members, clientID)
+	if len(members) == 0 {
+		delete(s.groups, group)
+	}
+}
+
+// leaveGroups removes a client from every group. Callers hold clientsMu.
+func (s *Server) leaveGroups(clientID string) {
+	for group, members := range s.groups {
+		delete(members, clientID)
+		if len(members) == 0 {
+			delete(s.groups, group)
+		}
+	}
+}
+
+// GroupMembers returns the IDs of the clients in group, sorted.
+func (s *Server) GroupMembers(group string) []string {
+	s.clientsMu.RLock()
+	ids := slices.Collect(maps.Keys(s.groups[group]))
+	s.clientsMu.RUnlock()
+	slices.Sort(ids)
+	return ids
+}
+
+// CallGroup calls method on every member of group. See Multicast.
+func (s *Server) CallGroup(group, method string, params map[string]any, timeout time.Duration) map[string]MulticastResult {
+	return s.Multicast(s.GroupMembers(group), method, params, timeout)
+}
+
+// NotifyGroup sends a notification to every active member of group. Failed
+// sends are joined into the returned error.
+func (s *Server) NotifyGroup(group, method string, params map[string]any) error {
+	active := s.activeClients()
+	conns := make(map[string]*Connection)
+	for _, id := range s.GroupMembers(group) {
+		if conn, ok := active[id]; ok {
+			conns[id] = conn
+		}
+	}
+	return fanOut(conns, func(c *Connection) error {
+		return c.Notify(method, params)
+	})
+}
+
+// Subscribe registers fn for a topic published by clients and subscribes
+// every connected and future client to it.
+func (s *Server) Subscribe(topic string, fn TopicHandler) {
+	s.topics.set(topic, fn)
+	for _, conn := range s.activeClients() {
+		_ = conn.sendTopic(SubscribeType, topic)
+	}
+}
+
+// Unsubscribe removes the handler for topic and unsubscribes every client.
+func (s *Server) Unsubscribe(topic string) {
+	s.topics.remove(topic)
+	for _, conn := range s.activeClients() {
+		_ = conn.sendTopic(UnsubscribeType, topic)
+	}
+}
+
+// Publish sends payload to every active client subscribed to topic. Failed
+// sends are joined into the returned error.
+func (s *Server) Publish(topic string, payload any) error {
+	return fanOut(s.subscribers(topic), func(c *Connection) error {
+		return c.Publish(topic, payload)
+	})
+}
+
+// Subscribers returns the IDs of the active clients subscribed to topic, sorted.
+func (s *Server) Subscribers(topic string) []string {
+	ids := slices.Collect(maps.Keys(s.subscribers(topic)))
+	slices.Sort(ids)
+	return ids
+}
+
+func (s *Server) subscribers(topic string) map[string]*Connection {
+	conns := s.activeClients()
+	maps.DeleteFunc(conns, func(_ string, c *Connection) bool {
+		return !c.PeerSubscribed(topic)
+	})
+	return conns
+}
+
 // Call sends a blocking RPC call to a client.
 func (s *Server) Call(clientID, method string, params map[string]any, timeout time.Duration) (any, error) {
 	conn := s.GetClientByID(clientID)
@@ -182,6 +730,71 @@ func (s *Server) CallAsyncWithResult(clientID, method string, params map[string]
 	return nil
 }
 
+// CallContext sends a blocking RPC call to a client, waiting until ctx is done.
+func (s *Server) CallContext(ctx context.Context, clientID, method string, params map[string]any) (any, error) {
+	conn := s.GetClientByID(clientID)
+	if conn == nil {
+		return nil, fmt.Errorf("client %s is not connected", clientID)
+	}
+	return conn.CallContext(ctx, method, params)
+}
+
+// CallWithResultContext sends a blocking RPC call and decodes the result into resultPtr.
+func (s *Server) CallWithResultContext(ctx context.Context, clientID, method string, params map[string]any, resultPtr any) error {
+	conn := s.GetClientByID(clientID)
+	if conn == nil {
+		return fmt.Errorf("client %s is not connected", clientID)
+	}
+	return conn.CallWithResultContext(ctx, method, params, resultPtr)
+}
+
+// CallAsyncContext sends an async call with callback, bounded by ctx.
+func (s *Server) CallAsyncContext(ctx context.Context, clientID, method string, params map[string]any, callback func(any, error)) error {
+	conn := s.GetClientByID(clientID)
+	if conn == nil {
+		return fmt.Errorf("client %s is not connected", clientID)
+	}
+	conn.CallAsyncContext(ctx, method, params, callback)
+	return nil
+}
+
+// CallAsyncWithResultContext sends an async call and decodes result into resultPtr, bounded by ctx.
+func (s *Server) CallAsyncWithResultContext(ctx context.Context, clientID, method string, params map[string]any, resultPtr any, callback func(error)) error {
+	conn := s.GetClientByID(clientID)
+	if conn == nil {
+		return fmt.Errorf("client %s is not connected", clientID)
+	}
+	conn.CallAsyncWithResultContext(ctx, method, params, resultPtr, callback)
+	return nil
+}
+
+// CallStream calls a streaming handler on a client. See Connection.CallStream.
+func (s *Server) CallStream(ctx context.Context, clientID, method string, params map[string]any) (*ResponseStream, error) {
+	conn := s.GetClientByID(clientID)
+	if conn == nil {
+		return nil, fmt.Errorf("client %s is not connected", clientID)
+	}
+	return conn.CallStream(ctx, method, params)
+}
+
+// Notify sends a one-way notification to a client. See Connection.Notify.
+func (s *Server) Notify(clientID, method string, params map[string]any) error {
+	conn := s.GetClientByID(clientID)
+	if conn == nil {
+		return fmt.Errorf("client %s is not connected", clientID)
+	}
+	return conn.Notify(method, params)
+}
+
+// OpenStream opens a bidirectional stream to a client. See Connection.OpenStream.
+func (s *Server) OpenStream(ctx context.Context, clientID, method string, params map[string]any) (*Stream, error) {
+	conn := s.GetClientByID(clientID)
+	if conn == nil {
+		return nil, fmt.Errorf("client %s is not connected", clientID)
+	}
+	return conn.OpenStream(ctx, method, params)
+}
+
 // Serve starts a plain TCP server and accepts incoming connections.
 func (s *Server) Serve(addr string) error {
 	ln, err := net.Listen("tcp", addr)
@@ -189,9 +802,28 @@ func (s *Server) Serve(addr string) error {
 		return fmt.Errorf("failed to listen on %s: %w", addr, err)
 	}
 	log.Println("[server] listening on", addr)
+	return s.ServeListener(ln)
+}
+
+// ServeListener accepts incoming connections on ln until the server is shut
+// down, in which case it returns ErrServerClosed. ln is closed on return.
+func (s *Server) ServeListener(ln net.Listener) error {
+	if !s.trackListener(ln, true) {
+		ln.Close()
+		return ErrServerClosed
+	}
+	defer s.trackListener(ln, false)
+	defer ln.Close()
+
 	for {
 		conn, err := ln.Accept()
 		if err != nil {
+			if s.shuttingDown() {
+				return ErrServerClosed
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return err
+			}
 			log.Println("[server] accept error:", err)
 			continue
 		}
@@ -206,13 +838,8 @@ func (s *Server) ServeTLS(addr string, tlsConfig *tls.Config) error {
 		return fmt.Errorf("failed to listen TLS on %s: %w", addr, err)
 	}
 	go func() {
-		for {
-			conn, err := ln.Accept()
-			if err != nil {
-				log.Println("[server] TLS accept error:", err)
-				continue
-			}
-			go s.ServeConn(conn)
+		if err := s.ServeListener(ln); err != nil && !errors.Is(err, ErrServerClosed) {
+			log.Println("[server] TLS accept error:", err)
 		}
 	}()
 	return nil
@@ -0,0 +1,84 @@
+package bidirpc
+
+import (
+	"fmt"
+	"reflect"
+)
+
+var (
+	typeOfContext = reflect.TypeOf((*Context)(nil))
+	typeOfError   = reflect.TypeOf((*error)(nil)).Elem()
+)
+
+// RegisterService registers every exported method of svc with the signature
+//
+//	func (s *T) Method(ctx *Context, args *A, reply *R) error
+//
+// as "name.Method", in the style of net/rpc. args may also be a value type.
+// Methods with other signatures are skipped. If name is empty, the type name
+// of svc is used.
+func (hr *HandlerRegistry) RegisterService(name string, svc any) error {
+	v := reflect.ValueOf(svc)
+	if !v.IsValid() {
+		return fmt.Errorf("service %q is nil", name)
+	}
+	t := v.Type()
+	if name == "" {
+		name = reflect.Indirect(v).Type().Name()
+	}
+	if name == "" {
+		return fmt.Errorf("no service name for type %s", t)
+	}
+
+	registered := 0
+	for i := 0; i < t.NumMethod(); i++ {
+		m := t.Method(i)
+		if !m.IsExported() || !isServiceMethod(m.Type) {
+			continue
+		}
+		hr.Register(name+"."+m.Name, serviceHandler(v.Method(i), m.Type.In(2), m.Type.In(3)))
+		registered++
+	}
+	if registered == 0 {
+		return fmt.Errorf("service %s has no exported methods of suitable type", name)
+	}
+	return nil
+}
+
+// isServiceMethod reports whether mt (including the receiver) has the form
+// func(recv, *Context, A, *R) error.
+func isServiceMethod(mt reflect.Type) bool {
+	if mt.NumIn() != 4 || mt.NumOut() != 1 {
+		return false
+	}
+	return mt.In(1) == typeOfContext &&
+		mt.In(3).Kind() == reflect.Ptr &&
+		mt.Out(0) == typeOfError
+}
+
+// serviceHandler adapts a bound service method to a HandlerFunc.
+func serviceHandler(fn reflect.Value, argType, replyType reflect.Type) HandlerFunc {
+	argIsPtr := argType.Kind() == reflect.Ptr
+	if argIsPtr {
+		argType = argType.Elem()
+	}
+
+	return func(ctx *Context) {
+		argv := reflect.New(argType)
+		if err := decodeInto(argv.Interface(), ctx.params); err != nil {
+			ctx.WriteError(ErrCodeBadRequest, "invalid params: "+err.Error())
+			return
+		}
+		if !argIsPtr {
+			argv = argv.Elem()
+		}
+
+		replyv := reflect.New(replyType.Elem())
+		out := fn.Call([]reflect.Value{reflect.ValueOf(ctx), argv, replyv})
+		if err, _ := out[0].Interface().(error); err != nil {
+			ctx.writeErr(err)
+			return
+		}
+		ctx.WriteResponse(replyv.Elem().Interface())
+	}
+}
@@ -0,0 +1,194 @@
+package bidirpc
+
+import (
+	"errors"
+	"log"
+	"slices"
+	"time"
+)
+
+// DuplicatePolicy decides what happens when a client authenticates with a
+// client ID that already has a live connection.
+type DuplicatePolicy int
+
+const (
+	// DuplicateKickOld closes the existing connection in favour of the new
+	// one. This is the default.
+	DuplicateKickOld DuplicatePolicy = iota
+	// DuplicateReject refuses the new connection while the existing one is
+	// alive. A connection that has not pinged within DefaultHeartbeatTimeout
+	// is replaced anyway.
+	DuplicateReject
+	// DuplicateAllow keeps every connection as a separate session. Calls by
+	// client ID go to the most recent session; use GetSession to address the
+	// others.
+	DuplicateAllow
+)
+
+func (p DuplicatePolicy) String() string {
+	switch p {
+	case DuplicateKickOld:
+		return "kick-old"
+	case DuplicateReject:
+		return "reject"
+	case DuplicateAllow:
+		return "allow"
+	}
+	return "unknown"
+}
+
+// DuplicateHandler is called when a client ID is already connected.
+// existing is the live connection and newcomer the one that just
+// authenticated; policy tells which of them was kept.
+type DuplicateHandler func(existing, newcomer *Connection, policy DuplicatePolicy)
+
+// ErrSessionReplaced is the disconnect reason of a connection closed in
+// favour of a newer one with the same client ID.
+var ErrSessionReplaced = errors.New("replaced by a newer connection with the same client ID")
+
+// errDuplicateClient is sent to clients refused by DuplicateReject.
+var errDuplicateClient = &AuthError{Code: "duplicate_client", Message: "client ID already connected"}
+
+// SetDuplicatePolicy sets how connections reusing a connected client ID are
+// handled.
+func (s *Server) SetDuplicatePolicy(p DuplicatePolicy) {
+	s.clientsMu.Lock()
+	defer s.clientsMu.Unlock()
+	s.dupPolicy = p
+}
+
+// OnDuplicateClient sets a function called whenever a client ID is already
+// connected when another connection authenticates with it.
+func (s *Server) OnDuplicateClient(fn DuplicateHandler) {
+	s.dupHook.Store(fn)
+}
+
+func (s *Server) duplicateClient(existing, newcomer *Connection, policy DuplicatePolicy) {
+	log.Printf("[server] duplicate client %s (policy %s)", newcomer.clientID, policy)
+	if fn, _ := s.dupHook.Load().(DuplicateHandler); fn != nil {
+		fn(existing, newcomer, policy)
+	}
+}
+
+// conflicting returns the live or joining connection that refuses a
+// newcomer with clientID under DuplicateReject, if any. Callers hold
+// clientsMu.
+func (s *Server) conflicting(clientID string) *Connection {
+	if s.dupPolicy != DuplicateReject {
+		return nil
+	}
+	if joining := s.joining[clientID]; joining != nil {
+		return joining
+	}
+	existing := s.clients[clientID]
+	if existing == nil || time.Since(s.lastPing[clientID]) > DefaultHeartbeatTimeout {
+		return nil
+	}
+	return existing
+}
+
+// reserve claims the client ID of c before the server tells it that it
+// authenticated, so that of two racing handshakes under DuplicateReject
+// only one succeeds. It returns the connection c conflicts with, if any.
+func (s *Server) reserve(c *Connection) *Connection {
+	s.clientsMu.Lock()
+	defer s.clientsMu.Unlock()
+
+	if existing := s.conflicting(c.clientID); existing != nil {
+		return existing
+	}
+	if s.dupPolicy == DuplicateReject {
+		s.joining[c.clientID] = c
+	}
+	return nil
+}
+
+// unreserve drops the claim of c on its client ID, e.g. when its handshake
+// fails.
+func (s *Server) unreserve(c *Connection) {
+	s.clientsMu.Lock()
+	defer s.clientsMu.Unlock()
+	if s.joining[c.clientID] == c {
+		delete(s.joining, c.clientID)
+	}
+}
+
+// admit registers c as the current session of its client ID according to
+// the duplicate policy. Conflicts under DuplicateReject were settled by
+// reserve. It returns the connection c replaced or joined, if any, and
+// false if the server is shutting down.
+func (s *Server) admit(c *Connection) (existing *Connection, policy DuplicatePolicy, ok bool) {
+	s.clientsMu.Lock()
+	defer s.clientsMu.Unlock()
+
+	policy = s.dupPolicy
+	if s.shuttingDown() {
+		return nil, policy, false
+	}
+	if s.joining[c.clientID] == c {
+		delete(s.joining, c.clientID)
+	}
+	existing = s.clients[c.clientID]
+	if existing != nil && policy == DuplicateReject {
+		// The existing connection went stale; replace it.
+		policy = DuplicateKickOld
+	}
+
+	s.clients[c.clientID] = c
+	s.sessions[c.sessionID] = c
+	s.byClient[c.clientID] = append(s.byClient[c.clientID], c)
+	s.lastPing[c.clientID] = time.Now()
+	s.conns[c] = struct{}{}
+	return existing, policy, true
+}
+
+// forget removes c from the server. If it was the current session of its
+// client ID, the most recent remaining session of the same client takes
+// over. The client leaves its groups once no session is left.
+func (s *Server) forget(c *Connection) {
+	s.clientsMu.Lock()
+	defer s.clientsMu.Unlock()
+
+	delete(s.sessions, c.sessionID)
+	delete(s.conns, c)
+	remaining := slices.DeleteFunc(s.byClient[c.clientID], func(other *Connection) bool {
+		return other == c
+	})
+	if len(remaining) > 0 {
+		s.byClient[c.clientID] = remaining
+		if s.clients[c.clientID] == c {
+			s.clients[c.clientID] = remaining[len(remaining)-1]
+		}
+		return
+	}
+	delete(s.byClient, c.clientID)
+	delete(s.clients, c.clientID)
+	delete(s.lastPing, c.clientID)
+	s.leaveGroups(c.clientID)
+}
+
+// GetSession returns the connection with the given session ID, or nil.
+func (s *Server) GetSession(sessionID string) *Connection {
+	s.clientsMu.RLock()
+	defer s.clientsMu.RUnlock()
+	return s.sessions[sessionID]
+}
+
+// ListSessions returns the session IDs of every connection of clientID,
+// sorted.
+func (s *Server) ListSessions(clientID string) []string {
+	s.clientsMu.RLock()
+	var ids []string
+	for _, c := range s.byClient[clientID] {
+		ids = append(ids, c.sessionID)
+	}
+	s.clientsMu.RUnlock()
+	slices.Sort(ids)
+	return ids
+}
+
+// SessionID returns the ID the server assigned to this connection. Clients
+// learn theirs from the handshake.
+func (c *Connection) SessionID() string {
+	return c.sessionID
+}
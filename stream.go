@@ -0,0 +1,428 @@
+package bidirpc
+
+import (
+	"context"
+	"errors"
+	"io"
+	"iter"
+	"log"
+	"sync"
+	"sync/atomic"
+
+	"github.com/google/uuid"
+)
+
+// ErrStreamingUnsupported is returned when the peer did not negotiate streaming.
+var ErrStreamingUnsupported = errors.New("peer does not support streaming")
+
+// ErrStreamOverflow is returned by Recv when more than maxStreamBacklog
+// messages arrived that were not received yet. The stream is abandoned.
+var ErrStreamOverflow = errors.New("stream receive buffer overflow")
+
+// maxStreamBacklog bounds the messages buffered for a single stream.
+const maxStreamBacklog = 1024
+
+// msgQueue is a bounded FIFO of messages for a single stream, so a slow
+// consumer never blocks the connection's read loop. Once full, it drops
+// everything and fails with ErrStreamOverflow.
+type msgQueue struct {
+	mu       sync.Mutex
+	items    []RPCMessage
+	overflow bool
+	notify   chan struct{}
+}
+
+func newMsgQueue() *msgQueue {
+	return &msgQueue{notify: make(chan struct{}, 1)}
+}
+
+// push appends msg. It reports false if the queue overflowed.
+func (q *msgQueue) push(msg RPCMessage) bool {
+	q.mu.Lock()
+	if len(q.items) >= maxStreamBacklog {
+		q.items = nil
+		q.overflow = true
+	}
+	if !q.overflow {
+		q.items = append(q.items, msg)
+	}
+	ok := !q.overflow
+	q.mu.Unlock()
+	select {
+	case q.notify <- struct{}{}:
+	default:
+	}
+	return ok
+}
+
+// pop returns the next message, waiting until one arrives, ctx is done or
+// c is closed.
+func (q *msgQueue) pop(ctx context.Context, c *Connection) (RPCMessage, error) {
+	for {
+		q.mu.Lock()
+		if q.overflow {
+			q.mu.Unlock()
+			return RPCMessage{}, ErrStreamOverflow
+		}
+		if len(q.items) > 0 {
+			msg := q.items[0]
+			q.items = q.items[1:]
+			q.mu.Unlock()
+			return msg, nil
+		}
+		q.mu.Unlock()
+
+		select {
+		case <-q.notify:
+		case <-ctx.Done():
+			return RPCMessage{}, ctx.Err()
+		case <-c.done:
+			return RPCMessage{}, c.Err()
+		}
+	}
+}
+
+// ResponseStream receives the items of a streamed response. It is not safe
+// for concurrent use by multiple goroutines.
+type ResponseStream struct {
+	ID string
+	st *Stream
+}
+
+// CallStream calls a streaming handler and returns the stream of items it
+// sends with Context.Send. The stream ends when the handler calls
+// Context.Close or returns; cancelling ctx or calling ResponseStream.Close
+// cancels the remote handler.
+func (c *Connection) CallStream(ctx context.Context, method string, params map[string]any) (*ResponseStream, error) {
+	st, err := c.startStream(ctx, RequestType, method, params)
+	if err != nil {
+		return nil, err
+	}
+	st.sendClosed = true
+	return &ResponseStream{ID: st.ID, st: st}, nil
+}
+
+// Recv returns the next item. It returns io.EOF once the handler closed the
+// stream without error, and a *ResponseError if it closed it with one.
+func (rs *ResponseStream) Recv() (any, error) {
+	return rs.st.Recv()
+}
+
+// RecvInto receives the next item and decodes it into resultPtr.
+func (rs *ResponseStream) RecvInto(resultPtr any) error {
+	return rs.st.RecvInto(resultPtr)
+}
+
+// All returns an iterator over the remaining items. Iteration stops after
+// the stream ends; a non-EOF error is yielded as the last element.
+func (rs *ResponseStream) All() iter.Seq2[any, error] {
+	return rs.st.All()
+}
+
+// Close stops receiving and cancels the remote handler if it is still running.
+func (rs *ResponseStream) Close() {
+	rs.st.Close()
+}
+
+// Stream is a full-duplex stream multiplexed on a Connection. The opener
+// gets it from OpenStream; the other peer receives it in a
+// StreamHandlerFunc. Send and Recv may be called from different goroutines,
+// but neither from several goroutines at once.
+type Stream struct {
+	ID         string
+	conn       *Connection
+	queue      *msgQueue
+	opener     bool
+	ctx        context.Context // opener side
+	cancel     context.CancelFunc
+	hctx       *Context    // handler side
+	ended      atomic.Bool // opener: the final response arrived
+	sendMu     sync.Mutex
+	sendClosed bool
+	recvErr    error // sticky error returned once receiving is over
+}
+
+// OpenStream opens a bidirectional stream to the stream handler registered
+// for method on the peer. Finish sending with CloseSend and read until Recv
+// returns io.EOF, or call Close to abort.
+func (c *Connection) OpenStream(ctx context.Context, method string, params map[string]any) (*Stream, error) {
+	return c.startStream(ctx, StreamOpenType, method, params)
+}
+
+// startStream sends the opening message of an outgoing stream and routes
+// the peer's replies to it.
+func (c *Connection) startStream(ctx context.Context, typ MessageType, method string, params map[string]any) (*Stream, error) {
+	if !c.Capabilities().Streaming {
+		return nil, ErrStreamingUnsupported
+	}
+	if err := c.checkCall(method); err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	st := &Stream{
+		ID:     uuid.NewString(),
+		conn:   c,
+		queue:  newMsgQueue(),
+		opener: true,
+		ctx:    ctx,
+		cancel: cancel,
+	}
+	c.addStream(st.ID, st.queue, &st.ended, true)
+
+	req := RPCMessage{
+		Type:   typ,
+		ID:     st.ID,
+		Method: method,
+		Params: params,
+	}
+	if err := c.Send(req); err != nil {
+		c.removeStream(st.ID)
+		cancel()
+		return nil, err
+	}
+
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-c.done:
+		}
+		c.removeStream(st.ID)
+		if !st.ended.Load() {
+			c.sendCancel(st.ID)
+		}
+	}()
+
+	return st, nil
+}
+
+// openStream serves a stream_open message from the peer.
+func (c *Connection) openStream(msg RPCMessage) {
+	ctx := c.newContext(msg)
+	fn := c.handlers.GetStream(msg.Method)
+	if fn == nil {
+		ctx.WriteError(ErrCodeMethodNotFound, "method not found")
+		return
+	}
+
+	st := &Stream{
+		ID:    msg.ID,
+		conn:  c,
+		queue: newMsgQueue(),
+		hctx:  ctx,
+	}
+	ctx.stream = st
+	c.addStream(st.ID, st.queue, &st.ended, false)
+
+	handler := func(ctx *Context) {
+		defer c.removeStream(st.ID)
+		fn(ctx)
+	}
+	if !c.startHandler(ctx, msg.Method, handler) {
+		c.removeStream(st.ID)
+	}
+}
+
+func (st *Stream) context() context.Context {
+	if st.opener {
+		return st.ctx
+	}
+	return st.hctx.Context()
+}
+
+// Send sends item to the peer. On the opener side it returns io.EOF once
+// the handler has ended the stream.
+func (st *Stream) Send(item any) error {
+	st.sendMu.Lock()
+	defer st.sendMu.Unlock()
+
+	if st.ended.Load() {
+		return io.EOF
+	}
+	if st.sendClosed {
+		return errors.New("send on closed stream")
+	}
+	if err := st.context().Err(); err != nil {
+		return err
+	}
+	return st.conn.Send(RPCMessage{
+		Type:   StreamType,
+		ID:     st.ID,
+		Result: item,
+	})
+}
+
+// CloseSend tells the peer that no more items will be sent. On the handler
+// side it ends the stream for the opener, as returning nil would.
+func (st *Stream) CloseSend() error {
+	st.sendMu.Lock()
+	defer st.sendMu.Unlock()
+
+	if st.sendClosed {
+		return nil
+	}
+	st.sendClosed = true
+	if st.opener {
+		return st.conn.Send(RPCMessage{Type: StreamCloseType, ID: st.ID})
+	}
+	return st.conn.Send(RPCMessage{Type: ResponseType, ID: st.ID})
+}
+
+// finish ends a handler-side stream with the handler's result.
+func (st *Stream) finish(err error) {
+	st.sendMu.Lock()
+	defer st.sendMu.Unlock()
+
+	if st.sendClosed {
+		if err != nil {
+			log.Printf("[conn] stream %s: handler error after CloseSend: %v", st.ID, err)
+		}
+		return
+	}
+	st.sendClosed = true
+	if err != nil {
+		_ = st.conn.Send(errorResponse(st.ID, err))
+		return
+	}
+	_ = st.conn.Send(RPCMessage{Type: ResponseType, ID: st.ID})
+}
+
+// Recv returns the next item from the peer. It returns io.EOF once the peer
+// has finished sending; on the opener side a handler error is returned as a
+// *ResponseError instead.
+func (st *Stream) Recv() (any, error) {
+	if st.recvErr != nil {
+		return nil, st.recvErr
+	}
+	msg, err := st.queue.pop(st.context(), st.conn)
+	if err != nil {
+		st.recvErr = err
+		return nil, err
+	}
+
+	switch msg.Type {
+	case StreamType:
+		return msg.Result, nil
+	case ResponseType:
+		// The handler is done; nothing is left to cancel.
+		if st.cancel != nil {
+			st.cancel()
+		}
+		if msg.Error != nil {
+			st.recvErr = &ResponseError{Code: msg.ErrorCode, Message: *msg.Error}
+		} else {
+			st.recvErr = io.EOF
+		}
+	default:
+		st.recvErr = io.EOF
+	}
+	return nil, st.recvErr
+}
+
+// RecvInto receives the next item and decodes it into resultPtr.
+func (st *Stream) RecvInto(resultPtr any) error {
+	item, err := st.Recv()
+	if err != nil {
+		return err
+	}
+	return decodeInto(resultPtr, item)
+}
+
+// All returns an iterator over the remaining items. Iteration stops after
+// the stream ends; a non-EOF error is yielded as the last element.
+func (st *Stream) All() iter.Seq2[any, error] {
+	return func(yield func(any, error) bool) {
+		for {
+			item, err := st.Recv()
+			if errors.Is(err, io.EOF) {
+				return
+			}
+			if !yield(item, err) || err != nil {
+				return
+			}
+		}
+	}
+}
+
+// Close aborts the stream on the opener side, cancelling the remote handler
+// if it is still running. It must be called once the stream is no longer
+// needed. On the handler side it is a no-op; return from the handler instead.
+func (st *Stream) Close() {
+	if st.opener {
+		st.cancel()
+	}
+}
+
+type streamEntry struct {
+	queue  *msgQueue
+	ended  *atomic.Bool
+	opener bool
+}
+
+func (c *Connection) addStream(id string, q *msgQueue, ended *atomic.Bool, opener bool) {
+	c.streamsMu.Lock()
+	c.streams[id] = streamEntry{queue: q, ended: ended, opener: opener}
+	c.streamsMu.Unlock()
+}
+
+func (c *Connection) removeStream(id string) {
+	c.streamsMu.Lock()
+	delete(c.streams, id)
+	c.streamsMu.Unlock()
+}
+
+// routeStream delivers msg to the stream with the same ID. It reports false
+// if there is no such stream. A stream whose queue overflows is dropped, and
+// the remote handler is cancelled if this side opened it.
+func (c *Connection) routeStream(msg RPCMessage) bool {
+	c.streamsMu.Lock()
+	entry, ok := c.streams[msg.ID]
+	if ok && msg.Type == ResponseType && entry.opener {
+		entry.ended.Store(true)
+		delete(c.streams, msg.ID)
+	}
+	c.streamsMu.Unlock()
+	if !ok {
+		return false
+	}
+	if msg.Type == ResponseType && !entry.opener {
+		// Only the handler side ends a stream with a response
+		log.Printf("[conn] stream %s: ignoring response from the opener", msg.ID)
+		return true
+	}
+	if !entry.queue.push(msg) {
+		log.Printf("[conn] stream %s: receiver fell behind, dropping stream", msg.ID)
+		c.removeStream(msg.ID)
+		if entry.opener && !entry.ended.Swap(true) {
+			c.sendCancel(msg.ID)
+		}
+	}
+	return true
+}
+
+// Send streams item to a caller using CallStream. Finish the stream with
+// Close, or by returning from the handler. It fails if the caller has
+// cancelled the call.
+func (ctx *Context) Send(item any) error {
+	if !ctx.conn.Capabilities().Streaming {
+		return ErrStreamingUnsupported
+	}
+	if err := ctx.Context().Err(); err != nil {
+		return err
+	}
+	ctx.streamed.Store(true)
+	return ctx.reply(RPCMessage{
+		Type:   StreamType,
+		ID:     ctx.id,
+		Result: item,
+	})
+}
+
+// Close ends a stream started with Send. A nil err ends it normally; a
+// *ResponseError keeps its code and other errors are sent as ErrCodeInternal.
+func (ctx *Context) Close(err error) error {
+	if err != nil {
+		return ctx.reply(errorResponse(ctx.id, err))
+	}
+	return ctx.reply(RPCMessage{Type: ResponseType, ID: ctx.id})
+}
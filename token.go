@@ -0,0 +1,216 @@
+package bidirpc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+)
+
+// ErrCredentialsExpired is the disconnect reason of a session whose
+// credentials lapsed without being renewed with Reauthenticate.
+var ErrCredentialsExpired = errors.New("credentials expired")
+
+// TokenSource returns a fresh bearer token for the AutoClient to present.
+type TokenSource func(ctx context.Context) (string, error)
+
+// JWTAuthenticator returns an Authenticator for JSON Web Tokens sent as
+// bearer tokens. keyFunc supplies the verification key and opts tune the
+// parser, e.g. jwt.WithValidMethods. The identity is taken from the claims:
+// "sub" is the client ID, "tenant" the tenant, "roles" a list of roles and
+// "exp" the expiry of the session. Tokens without a "sub" or "exp" claim are
+// refused, so every session expires.
+func JWTAuthenticator(keyFunc jwt.Keyfunc, opts ...jwt.ParserOption) Authenticator {
+	parser := jwt.NewParser(append([]jwt.ParserOption{jwt.WithExpirationRequired()}, opts...)...)
+	return AuthenticatorFunc(func(ctx context.Context, creds Credentials) (*Identity, error) {
+		if creds.Token == "" {
+			return nil, &AuthError{Code: "token_required", Message: "bearer token required"}
+		}
+		claims := jwt.MapClaims{}
+		if _, err := parser.ParseWithClaims(creds.Token, claims, keyFunc); err != nil {
+			if errors.Is(err, jwt.ErrTokenExpired) {
+				return nil, &AuthError{Code: "token_expired", Message: "token expired"}
+			}
+			if errors.Is(err, jwt.ErrTokenRequiredClaimMissing) {
+				return nil, &AuthError{Code: "invalid_token", Message: "token has no expiry"}
+			}
+			return nil, &AuthError{Code: "invalid_token", Message: "invalid token"}
+		}
+
+		id := &Identity{Claims: claims}
+		id.ClientID, _ = claims["sub"].(string)
+		if id.ClientID == "" {
+			return nil, &AuthError{Code: "invalid_token", Message: "token has no subject"}
+		}
+		id.Tenant, _ = claims["tenant"].(string)
+		if roles, ok := claims["roles"].([]any); ok {
+			for _, r := range roles {
+				if role, ok := r.(string); ok {
+					id.Roles = append(id.Roles, role)
+				}
+			}
+		}
+		if exp, err := claims.GetExpirationTime(); err == nil && exp != nil {
+			id.ExpiresAt = exp.Time
+		}
+		return id, nil
+	})
+}
+
+// ExpiresAt returns when the credentials of the connection lapse, or the
+// zero time if they do not expire. On the server side, the connection is
+// closed with ErrCredentialsExpired at that point.
+func (c *Connection) ExpiresAt() time.Time {
+	c.expiryMu.Lock()
+	defer c.expiryMu.Unlock()
+	return c.expiresAt
+}
+
+// setIdentity attaches id to c and arms the expiry timer for it.
+func (c *Connection) setIdentity(id *Identity) {
+	c.identity.Store(id)
+	c.setExpiry(id.ExpiresAt, true)
+}
+
+// setExpiry records when the connection's credentials lapse. If enforce is
+// set, the connection is closed at that time unless the expiry is renewed.
+func (c *Connection) setExpiry(at time.Time, enforce bool) {
+	c.expiryMu.Lock()
+	defer c.expiryMu.Unlock()
+
+	if c.expiryTimer != nil {
+		c.expiryTimer.Stop()
+		c.expiryTimer = nil
+	}
+	c.expiresAt = at
+	if at.IsZero() || !enforce {
+		return
+	}
+	c.expiryTimer = time.AfterFunc(time.Until(at), func() {
+		c.expiryMu.Lock()
+		renewed := !c.expiresAt.Equal(at)
+		c.expiryMu.Unlock()
+		if !renewed {
+			log.Printf("[conn] credentials of %s expired", c.clientID)
+			c.closeWithReason(ErrCredentialsExpired)
+		}
+	})
+}
+
+// stopExpiry disarms the expiry timer of a closed connection.
+func (c *Connection) stopExpiry() {
+	c.expiryMu.Lock()
+	defer c.expiryMu.Unlock()
+	if c.expiryTimer != nil {
+		c.expiryTimer.Stop()
+	}
+}
+
+// Reauthenticate presents a new token to the server over the open
+// connection and returns the new expiry. The session keeps its client ID;
+// on failure the current credentials stay in effect until they expire.
+func (c *Connection) Reauthenticate(ctx context.Context, token string) (time.Time, error) {
+	res, err := c.exchange(ctx, RPCMessage{
+		Type:   ReauthType,
+		ID:     uuid.NewString(),
+		Params: map[string]any{"token": token},
+	})
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	var expiresAt time.Time
+	if s, _ := res.(string); s != "" {
+		if expiresAt, err = time.Parse(time.RFC3339Nano, s); err != nil {
+			return time.Time{}, fmt.Errorf("invalid expiry in reauth response: %w", err)
+		}
+	}
+	c.setExpiry(expiresAt, false)
+	return expiresAt, nil
+}
+
+// handleReauth serves a reauth message from the client.
+func (c *Connection) handleReauth(msg RPCMessage) {
+	ctx := c.newContext(msg)
+	if c.reauth == nil {
+		ctx.WriteError(ErrCodeUnauthorized, "reauthentication not supported")
+		return
+	}
+	token, _ := msg.Params["token"].(string)
+	id, err := c.reauth(token)
+	if err != nil {
+		var authErr *AuthError
+		if !errors.As(err, &authErr) {
+			authErr = errInvalidCredentials
+		}
+		ctx.WriteError(ErrCodeUnauthorized, authErr.Message)
+		return
+	}
+
+	c.setIdentity(id)
+	if id.ExpiresAt.IsZero() {
+		ctx.WriteResponse("")
+		return
+	}
+	ctx.WriteResponse(id.ExpiresAt.Format(time.RFC3339Nano))
+}
+
+// reauthenticate checks a token presented by c during the session. The new
+// identity must name the same client. Failures count towards the
+// authentication backoff of the client's IP, like failed handshakes.
+func (s *Server) reauthenticate(c *Connection, token string) (*Identity, error) {
+	ip := remoteIP(c.Conn)
+	if s.admission.backingOff(ip) {
+		return nil, &AuthError{Code: "backing_off", Message: errBackingOff.Error()}
+	}
+	id, err := s.authenticate(c, NegotiationMessage{ClientID: c.clientID, Token: token})
+	if err == nil && id.ClientID != c.clientID {
+		err = &AuthError{Code: "identity_mismatch", Message: "token names a different client"}
+	}
+	if err != nil {
+		log.Printf("[server] reauthentication failed for client %s: %v", c.clientID, err)
+		s.authFailed(c.clientID, c.Conn.RemoteAddr(), ip, err)
+		return nil, err
+	}
+	s.admission.authSucceeded(ip)
+	return id, nil
+}
+
+// refreshCredentials renews the token of c with the token source before it
+// expires, until c is closed. If renewal keeps failing, the server closes
+// the session when the token lapses and the reconnect loop takes over.
+func (ac *AutoClient) refreshCredentials(c *Connection, source TokenSource) {
+	const retryDelay = 5 * time.Second
+	for {
+		expiresAt := c.ExpiresAt()
+		if expiresAt.IsZero() || !time.Now().Before(expiresAt) {
+			return
+		}
+		// Renew once 80% of the remaining lifetime has passed
+		wait := time.Until(expiresAt) * 4 / 5
+		select {
+		case <-c.done:
+			return
+		case <-time.After(wait):
+		}
+
+		ctx, cancel := context.WithTimeout(c.ctx, retryDelay)
+		token, err := source(ctx)
+		if err == nil {
+			_, err = c.Reauthenticate(ctx, token)
+		}
+		cancel()
+		if err != nil {
+			log.Println("[client] credential refresh failed:", err)
+			select {
+			case <-c.done:
+				return
+			case <-time.After(min(retryDelay, time.Until(expiresAt))):
+			}
+		}
+	}
+}
@@ -0,0 +1,45 @@
+package bidirpc
+
+import (
+	"context"
+)
+
+// Caller is implemented by Connection and AutoClient.
+type Caller interface {
+	CallContext(ctx context.Context, method string, params map[string]any) (any, error)
+}
+
+// Handle registers a typed handler for method. The request params are decoded
+// into Req, a returned Resp is sent with WriteResponse and a returned error
+// with WriteError. A *ResponseError keeps its code; other errors are sent
+// as ErrCodeInternal.
+func Handle[Req, Resp any](registry *HandlerRegistry, method string, fn func(ctx *Context, req Req) (Resp, error), mw ...Middleware) {
+	registry.Register(method, func(ctx *Context) {
+		var req Req
+		if err := decodeInto(&req, ctx.params); err != nil {
+			ctx.WriteError(ErrCodeBadRequest, "invalid params: "+err.Error())
+			return
+		}
+		resp, err := fn(ctx, req)
+		if err != nil {
+			ctx.writeErr(err)
+			return
+		}
+		ctx.WriteResponse(resp)
+	}, mw...)
+}
+
+// Invoke calls method with req encoded as params and decodes the result into Resp.
+func Invoke[Req, Resp any](ctx context.Context, conn Caller, method string, req Req) (Resp, error) {
+	var resp Resp
+	params, err := encodeParams(req)
+	if err != nil {
+		return resp, err
+	}
+	res, err := conn.CallContext(ctx, method, params)
+	if err != nil {
+		return resp, err
+	}
+	err = decodeInto(&resp, res)
+	return resp, err
+}
@@ -1,6 +1,7 @@
 package bidirpc
 
 import (
+	"bytes"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -46,3 +47,50 @@ func decodeInto(result any, src any) error {
 	}
 	return json.Unmarshal(data, result)
 }
+
+// encodeParams converts v into request params using its JSON representation.
+// Integers are kept as int64 rather than float64.
+func encodeParams(v any) (map[string]any, error) {
+	if v == nil {
+		return nil, nil
+	}
+	if m, ok := v.(map[string]any); ok {
+		return m, nil
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, fmt.Errorf("encode params: %w", err)
+	}
+	if bytes.Equal(data, []byte("null")) {
+		return nil, nil
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var params map[string]any
+	if err := dec.Decode(&params); err != nil {
+		return nil, fmt.Errorf("params must encode to a JSON object: %w", err)
+	}
+	return normalizeNumbers(params).(map[string]any), nil
+}
+
+// normalizeNumbers replaces json.Number values with int64 or float64.
+func normalizeNumbers(v any) any {
+	switch val := v.(type) {
+	case json.Number:
+		if i, err := val.Int64(); err == nil {
+			return i
+		}
+		f, _ := val.Float64()
+		return f
+	case map[string]any:
+		for k, item := range val {
+			val[k] = normalizeNumbers(item)
+		}
+	case []any:
+		for i, item := range val {
+			val[i] = normalizeNumbers(item)
+		}
+	}
+	return v
+}